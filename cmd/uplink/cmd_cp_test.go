@@ -4,11 +4,15 @@
 package main
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"storj.io/common/memory"
+	"storj.io/common/storj"
+	"storj.io/storj/cmd/uplink/ulloc"
 	"storj.io/storj/cmd/uplink/ultest"
 )
 
@@ -282,6 +286,68 @@ func TestCpUpload(t *testing.T) {
 	})
 }
 
+func TestCpUploadDefaultRetention(t *testing.T) {
+	state := ultest.Setup(commands,
+		ultest.WithBucketOptions("locked", &ultest.MakeBucketOptions{
+			DefaultRetention: ultest.DefaultRetention{Mode: storj.ComplianceMode, Period: time.Hour},
+		}),
+		ultest.WithFile("/home/user/file1.txt", "local"),
+	)
+
+	before := time.Now()
+	result := state.Succeed(t, "cp", "/home/user/file1.txt", "sj://locked/file1.txt")
+
+	retention, err := result.Remote.Retention(ulloc.NewRemote("locked", "file1.txt"))
+	require.NoError(t, err)
+	require.Equal(t, storj.ComplianceMode, retention.Mode)
+	require.False(t, retention.RetainUntil.Before(before.Add(time.Hour)))
+
+	// the inherited retention prevents overwriting the upload.
+	result = state.With(ultest.WithFile("sj://locked/file1.txt", "remote")).
+		Fail(t, "cp", "/home/user/file1.txt", "sj://locked/file1.txt")
+	require.ErrorContains(t, result.Err, "protected by object lock")
+}
+
+func TestCpUploadExpires(t *testing.T) {
+	state := ultest.Setup(commands,
+		ultest.WithBucket("user"),
+		ultest.WithFile("/home/user/file1.txt", "local"),
+	)
+
+	state.Succeed(t, "cp", "/home/user/file1.txt", "sj://user/file1.txt", "--expires", "+1h").RequireFiles(t,
+		ultest.File{Loc: "/home/user/file1.txt", Contents: "local"},
+		ultest.File{Loc: "sj://user/file1.txt", Contents: "local"},
+	)
+
+	// moving the clock of the remote past the expiration hides the upload.
+	later := time.Now().Add(2 * time.Hour)
+	state.With(ultest.WithClock(func() time.Time { return later })).
+		Succeed(t, "cp", "/home/user/file1.txt", "sj://user/file1.txt", "--expires", "+1h").RequireFiles(t,
+		ultest.File{Loc: "/home/user/file1.txt", Contents: "local"},
+	)
+}
+
+func TestCpDownloadServerSideEncryption(t *testing.T) {
+	sse := ultest.ServerSideEncryption{Algorithm: "AES256", Key: "secret"}
+	state := ultest.Setup(commands,
+		ultest.WithServerSideEncryption(sse),
+		ultest.WithFile("sj://user/file1.txt", "remote"),
+	)
+
+	result := state.Succeed(t, "cp", "sj://user/file1.txt", "/home/user/file1.txt").RequireLocalFiles(t,
+		ultest.File{Loc: "/home/user/file1.txt", Contents: "remote"},
+	)
+	info, err := result.Remote.Stat(context.Background(), "user", "file1.txt")
+	require.NoError(t, err)
+	require.Equal(t, "AES256", info.EncryptionAlgorithm)
+	require.Empty(t, info.Metadata)
+
+	// without the key the download fails.
+	result = state.With(ultest.WithServerSideEncryption(ultest.ServerSideEncryption{})).
+		Fail(t, "cp", "sj://user/file1.txt", "/home/user/file1.txt")
+	require.ErrorContains(t, result.Err, "requires server-side encryption key")
+}
+
 func TestCpRecursiveDifficult(t *testing.T) {
 	t.Run("Success", func(t *testing.T) {
 		state := ultest.Setup(commands,
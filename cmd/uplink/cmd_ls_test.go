@@ -4,8 +4,13 @@
 package main
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/require"
+
+	"storj.io/storj/cmd/uplink/ulloc"
 	"storj.io/storj/cmd/uplink/ultest"
 )
 
@@ -161,6 +166,41 @@ func TestLsJSON(t *testing.T) {
 	})
 }
 
+func TestLsPendingClock(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := start
+	advance := func(d time.Duration) ultest.ExecuteOption {
+		return ultest.WithRemote(func(*testing.T, context.Context, *ultest.RemoteFilesystem) { now = now.Add(d) })
+	}
+
+	state := ultest.Setup(commands,
+		ultest.WithClock(func() time.Time { return now }),
+		ultest.WithPendingFile("sj://user/stale"),
+		advance(2*time.Hour),
+		ultest.WithPendingFile("sj://user/fresh"),
+	)
+
+	now = start
+	result := state.Succeed(t, "ls", "sj://user", "--pending", "--utc").RequireStdout(t, `
+		KIND    CREATED                SIZE    KEY
+		OBJ     2024-01-02 05:04:05    0       fresh
+		OBJ     2024-01-02 03:04:05    0       stale
+	`)
+
+	infos, err := result.Remote.ListUploads(context.Background(), ulloc.NewRemote("user", ""), &ultest.ListUploadsOptions{
+		OlderThan: time.Hour,
+	})
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, ulloc.NewRemote("user", "stale"), infos[0].Loc)
+
+	require.Equal(t, []ulloc.Location{ulloc.NewRemote("user", "stale")}, result.Remote.OrphanedUploads(time.Hour))
+
+	// the uploads age with the clock.
+	now = now.Add(2 * time.Hour)
+	require.Len(t, result.Remote.OrphanedUploads(time.Hour), 2)
+}
+
 func TestLsPending(t *testing.T) {
 	state := ultest.Setup(commands,
 		ultest.WithPendingFile("sj://user/deep/aaa/bbb/1"),
@@ -6,6 +6,9 @@ package main
 import (
 	"testing"
 
+	"github.com/stretchr/testify/require"
+
+	"storj.io/storj/cmd/uplink/ulloc"
 	"storj.io/storj/cmd/uplink/ultest"
 )
 
@@ -25,6 +28,38 @@ func TestRmRemote(t *testing.T) {
 		)
 	})
 
+	t.Run("Versioned", func(t *testing.T) {
+		state := ultest.Setup(commands,
+			ultest.WithBucketOptions("user", &ultest.MakeBucketOptions{Versioning: ultest.VersioningEnabled}),
+			ultest.WithFile("sj://user/file1.txt", "first"),
+			ultest.WithFile("sj://user/file1.txt", "second"),
+		)
+
+		result := state.Succeed(t, "rm", "sj://user/file1.txt").RequireFiles(t)
+
+		versions := result.Remote.Versions(ulloc.NewRemote("user", "file1.txt"))
+		require.Len(t, versions, 3)
+		require.Equal(t, int64(len("first")), versions[0].ContentLength)
+		require.Equal(t, int64(len("second")), versions[1].ContentLength)
+		require.True(t, versions[2].IsDeleteMarker)
+	})
+
+	t.Run("Empties Bucket", func(t *testing.T) {
+		state := ultest.Setup(commands,
+			ultest.WithFile("sj://user/file1.txt"),
+		)
+
+		result := state.Succeed(t, "rm", "sj://user/file1.txt")
+		empty, err := result.Remote.IsBucketEmpty("user")
+		require.NoError(t, err)
+		require.True(t, empty)
+
+		result = state.With(ultest.WithPendingFile("sj://user/file2.txt")).Succeed(t, "rm", "sj://user/file1.txt")
+		empty, err = result.Remote.IsBucketEmpty("user")
+		require.NoError(t, err)
+		require.False(t, empty)
+	})
+
 	t.Run("Recursive", func(t *testing.T) {
 		state := ultest.Setup(commands,
 			ultest.WithFile("sj://user/files/file1.txt"),
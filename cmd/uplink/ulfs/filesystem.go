@@ -80,12 +80,17 @@ type FilesystemRemote interface {
 // ObjectInfo is a simpler *uplink.Object that contains the minimal information the
 // uplink command needs that multiple types can be converted to.
 type ObjectInfo struct {
-	Loc           ulloc.Location
-	IsPrefix      bool
-	Created       time.Time
-	ContentLength int64
-	Expires       time.Time
-	Metadata      uplink.CustomMetadata
+	Loc            ulloc.Location
+	IsPrefix       bool
+	IsDeleteMarker bool
+	Created        time.Time
+	ContentLength  int64
+	Expires        time.Time
+	Metadata       uplink.CustomMetadata
+
+	// EncryptionAlgorithm is the server-side encryption algorithm of the
+	// object, when the backend reports one.
+	EncryptionAlgorithm string
 }
 
 // uplinkObjectToObjectInfo returns an objectInfo converted from an *uplink.Object.
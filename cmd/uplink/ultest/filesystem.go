@@ -6,13 +6,21 @@ package ultest
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
 	"io"
+	"math/rand"
+	"net/http"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/zeebo/errs"
 
+	"storj.io/common/sync2"
 	"storj.io/storj/cmd/uplink/ulfs"
 	"storj.io/storj/cmd/uplink/ulloc"
 )
@@ -21,41 +29,300 @@ import (
 // ulfs.Filesystem
 //
 
-type remoteFilesystem struct {
+// RemoteFilesystem is the in-memory remote filesystem that commands run
+// against. Tests can configure it with WithRemote and inspect it through
+// Result.Remote.
+type RemoteFilesystem struct {
 	created int64
 	files   map[ulloc.Location]memFileData
 	pending map[ulloc.Location][]*memWriteHandle
-	buckets map[string]struct{}
+	buckets map[string]memBucket
+
+	// version is the version assigned to the last committed file.
+	version int64
+	// versions are the noncurrent versions of the files, oldest first.
+	versions map[ulloc.Location][]memFileData
+
+	// now returns the current time and can be replaced to control time.
+	now func() time.Time
+	// createdClock, when set, provides the created time of new uploads
+	// instead of the increasing counter, allowing it to go backwards.
+	createdClock func() time.Time
+	// deleteGrace is how long a removed file stays readable through Open
+	// while being hidden from listings.
+	deleteGrace time.Duration
+	// sse is the server-side encryption of requests without one in their
+	// context, like a key configured for the client.
+	sse ServerSideEncryption
+	// normalizeKey, when set, is applied to keys passed to Create, Open
+	// and Remove.
+	normalizeKey func(key string) string
+	// observers are called with the lock held after every operation.
+	observers []func(Operation)
+	// removeBucketErr, when set, is returned by a forced RemoveBucket after
+	// removeBucketErrAfter files have been removed.
+	removeBucketErr      error
+	removeBucketErrAfter int
+	// commitDelay is how long Commit takes to finalize an upload. The delay
+	// is split into commitSteps increments, each reported to commitProgress.
+	commitDelay    time.Duration
+	commitSteps    int
+	commitProgress func(loc ulloc.Location, committed, total int64)
+	// corruptDownloads flips a byte of the contents returned by Open while
+	// keeping the stored checksum intact.
+	corruptDownloads bool
+	// denied are the permissions denied for operations under the prefixes.
+	denied []deniedPermission
+	// readOnly rejects all the operations that would modify the filesystem.
+	readOnly bool
+	// maxListLimit, when positive, is the largest MaxKeys accepted by
+	// ListObjects. Larger requests are clamped, or rejected when
+	// rejectListLimit is set.
+	maxListLimit    int
+	rejectListLimit bool
+	// sniffContentType stores the content type detected from the contents
+	// of committed files that don't have one in their metadata.
+	sniffContentType bool
+	// minPartSize is the minimum size of every part of a multipart upload
+	// except the last one.
+	minPartSize int64
+	// discardContents makes uploads only record the size and the checksum
+	// of the written data, allowing large uploads without keeping them in
+	// memory.
+	discardContents bool
+	// listErrors are returned by listings when they reach the locations,
+	// stopping them there.
+	listErrors map[ulloc.Location]error
+	// truncateCommits makes commits store only the first truncatedLength
+	// bytes of the buffered contents, like an interrupted finalize.
+	truncateCommits bool
+	truncatedLength int64
+	// shuffleListObjects makes List and ListObjects return their results in
+	// a random order determined by shuffleSeed, like a backend without
+	// ordering.
+	shuffleListObjects bool
+	shuffleSeed        int64
+	// loseCommits makes commits report success without storing the file,
+	// like a write whose acknowledgment was sent but that never persisted.
+	loseCommits bool
+	// assignKeySuffix, when set, returns a suffix that commits append to the
+	// requested key, like a server assigning the final key of an upload.
+	assignKeySuffix func() string
+	// requestIDs, when set, generates the request IDs of the operations.
+	requestIDs *rand.Rand
 
 	mu sync.Mutex
 }
 
-func newRemoteFilesystem() *remoteFilesystem {
-	return &remoteFilesystem{
-		files:   make(map[ulloc.Location]memFileData),
-		pending: make(map[ulloc.Location][]*memWriteHandle),
-		buckets: make(map[string]struct{}),
+// ErrReadOnly is returned for operations that modify a read-only filesystem.
+var ErrReadOnly = errs.Class("read-only")
+
+// checkWritable returns an error when the filesystem is read-only.
+func (rfs *RemoteFilesystem) checkWritable(op string, loc ulloc.Location) error {
+	if rfs.readOnly {
+		return ErrReadOnly.New("%s %q", op, loc)
+	}
+	return nil
+}
+
+func newRemoteFilesystem() *RemoteFilesystem {
+	return &RemoteFilesystem{
+		files:    make(map[ulloc.Location]memFileData),
+		pending:  make(map[ulloc.Location][]*memWriteHandle),
+		buckets:  make(map[string]memBucket),
+		versions: make(map[ulloc.Location][]memFileData),
+		now:      time.Now,
 	}
 }
 
 type memFileData struct {
-	contents string
-	created  int64
-	expires  time.Time
-	metadata map[string]string
+	contents   string
+	created    int64
+	version    int64
+	expires    time.Time
+	metadata   map[string]string
+	deleted    time.Time
+	encryption ServerSideEncryption
+	retention  Retention
+	parts      []memPart
+	checksum   [sha256.Size]byte
+	// discarded is set when only the size and the checksum of the contents
+	// were recorded, in which case length holds the size.
+	discarded bool
+	length    int64
+	// null is set for files committed while versioning wasn't enabled,
+	// which are overwritten by later commits.
+	null bool
+	// truncated is set when the commit lost the end of the contents.
+	truncated bool
+	// deleteMarker is set for the versions created by removing a file in a
+	// versioned bucket. They are also removed, but never readable.
+	deleteMarker bool
+}
+
+// size returns the size of the contents.
+func (mf memFileData) size() int64 {
+	if mf.discarded {
+		return mf.length
+	}
+	return int64(len(mf.contents))
+}
+
+// ContentTypeMetadataKey is the metadata key holding the content type of an
+// object.
+const ContentTypeMetadataKey = "content-type"
+
+// ServerSideEncryption describes customer provided server-side encryption.
+type ServerSideEncryption struct {
+	Algorithm string
+	Key       string
+}
+
+type serverSideEncryptionKey struct{}
+
+// ContextWithServerSideEncryption returns a context that requests server-side
+// encryption for uploads created with it and provides the decryption key for
+// downloads opened with it. It overrides WithServerSideEncryption.
+func ContextWithServerSideEncryption(ctx context.Context, sse ServerSideEncryption) context.Context {
+	return context.WithValue(ctx, serverSideEncryptionKey{}, sse)
 }
 
-func (mf memFileData) expired() bool {
-	return mf.expires != time.Time{} && mf.expires.Before(time.Now())
+// serverSideEncryption returns the server-side encryption requested by the
+// context, or the one set with WithServerSideEncryption.
+func (rfs *RemoteFilesystem) serverSideEncryption(ctx context.Context) ServerSideEncryption {
+	if sse, ok := ctx.Value(serverSideEncryptionKey{}).(ServerSideEncryption); ok {
+		return sse
+	}
+	return rfs.sse
+}
+
+// copyMetadata returns a copy of the metadata, or nil when it is empty.
+func copyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		copied[k] = v
+	}
+	return copied
+}
+
+// createdTime converts the created counter into a time. Zero is used for files
+// without a created time, like some legacy objects, and converts to the zero
+// time.
+func createdTime(created int64) time.Time {
+	if created == 0 {
+		return time.Time{}
+	}
+	return time.Unix(created, 0)
+}
+
+// createdNow returns the current time to compute the ages of uploads from
+// their created times.
+//
+// Without a created clock, created times come from a counter that advances by
+// a second on every upload, so "now" is the last counter value and an age is
+// the number of uploads created since, in seconds. It doesn't grow with time.
+//
+// With a created clock, ages are measured against now. WithClock uses the
+// same clock for both, while WithCreatedClock alone can skew created times
+// against now.
+func (rfs *RemoteFilesystem) createdNow() time.Time {
+	if rfs.createdClock != nil {
+		return rfs.now()
+	}
+	return time.Unix(rfs.created, 0)
+}
+
+// objectInfo returns the object info of the file stored at the location.
+func (mf memFileData) objectInfo(loc ulloc.Location) ulfs.ObjectInfo {
+	return ulfs.ObjectInfo{
+		Loc:           loc,
+		Created:       createdTime(mf.created),
+		Expires:       mf.expires,
+		ContentLength: mf.size(),
+		Metadata:      copyMetadata(mf.metadata),
+
+		EncryptionAlgorithm: mf.encryption.Algorithm,
+	}
+}
+
+func (mf memFileData) expired(now time.Time) bool {
+	return mf.expires != time.Time{} && mf.expires.Before(now)
+}
+
+// removed returns true if the file was removed while the delete grace period
+// was enabled and is only kept around to be readable.
+func (mf memFileData) removed() bool {
+	return mf.deleted != time.Time{}
+}
+
+// gone returns whether the file was removed and its delete grace period has
+// passed. Such files are treated as if they didn't exist until removing their
+// bucket purges them.
+func (rfs *RemoteFilesystem) gone(mf memFileData) bool {
+	return mf.removed() && !mf.deleteMarker && rfs.now().Sub(mf.deleted) >= rfs.deleteGrace
+}
+
+// lookup returns the file at the location if it exists and was not removed.
+func (rfs *RemoteFilesystem) lookup(loc ulloc.Location) (memFileData, bool) {
+	mf, ok := rfs.files[loc]
+	if !ok || mf.removed() {
+		return memFileData{}, false
+	}
+	return mf, true
+}
+
+// location returns the location for the bucket and key after applying the
+// key normalizer.
+func (rfs *RemoteFilesystem) location(bucket, key string) ulloc.Location {
+	if rfs.normalizeKey != nil {
+		key = rfs.normalizeKey(key)
+	}
+	return ulloc.NewRemote(bucket, key)
+}
+
+// Operation describes an operation performed on the remote filesystem.
+type Operation struct {
+	Name  string
+	Loc   ulloc.Location
+	Bytes int64
+	Err   error
+
+	// RequestID identifies the operation when request IDs are enabled, see
+	// WithRequestIDs.
+	RequestID string
+}
+
+// observe reports the operation to all the registered observers.
+func (rfs *RemoteFilesystem) observe(name string, loc ulloc.Location, size int64, err error) {
+	var requestID string
+	if rfs.requestIDs != nil {
+		requestID = hex.EncodeToString(binary.BigEndian.AppendUint64(nil, rfs.requestIDs.Uint64()))
+	}
+
+	for _, observer := range rfs.observers {
+		observer(Operation{
+			Name:      name,
+			Loc:       loc,
+			Bytes:     size,
+			Err:       err,
+			RequestID: requestID,
+		})
+	}
 }
 
-func (rfs *remoteFilesystem) ensureBucket(name string) {
-	rfs.buckets[name] = struct{}{}
+func (rfs *RemoteFilesystem) ensureBucket(name string) {
+	if _, ok := rfs.buckets[name]; !ok {
+		rfs.buckets[name] = memBucket{}
+	}
 }
 
-func (rfs *remoteFilesystem) Files() (files []File) {
+// Files returns the committed files that are neither expired nor removed.
+func (rfs *RemoteFilesystem) Files() (files []File) {
 	for loc, mf := range rfs.files {
-		if mf.expired() {
+		if mf.expired(rfs.now()) || mf.removed() {
 			continue
 		}
 		files = append(files, File{
@@ -68,7 +335,124 @@ func (rfs *remoteFilesystem) Files() (files []File) {
 	return files
 }
 
-func (rfs *remoteFilesystem) Pending() (files []File) {
+// FilesMap returns the same files as Files keyed by their location.
+func (rfs *RemoteFilesystem) FilesMap() map[string]File {
+	files := rfs.Files()
+	byLoc := make(map[string]File, len(files))
+	for _, file := range files {
+		byLoc[file.Loc] = file
+	}
+	return byLoc
+}
+
+// Snapshot returns the current files, which can be compared with a later
+// snapshot using Snapshot.Diff.
+func (rfs *RemoteFilesystem) Snapshot() Snapshot {
+	return Snapshot(rfs.Files())
+}
+
+// ValidateNoCaseCollisions returns an error describing the files whose
+// locations differ only in case, which are usually mistakes in test fixtures.
+func (rfs *RemoteFilesystem) ValidateNoCaseCollisions() error {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	folded := make(map[ulloc.Location][]ulloc.Location)
+	for loc, mf := range rfs.files {
+		if mf.removed() {
+			continue
+		}
+		bucket, key, _ := loc.RemoteParts()
+		lower := ulloc.NewRemote(bucket, strings.ToLower(key))
+		folded[lower] = append(folded[lower], loc)
+	}
+
+	var collisions []string
+	for _, locs := range folded {
+		if len(locs) < 2 {
+			continue
+		}
+		sort.Slice(locs, func(i, j int) bool { return locs[i].Less(locs[j]) })
+		names := make([]string, 0, len(locs))
+		for _, loc := range locs {
+			names = append(names, loc.String())
+		}
+		collisions = append(collisions, strings.Join(names, ", "))
+	}
+	if len(collisions) == 0 {
+		return nil
+	}
+	sort.Strings(collisions)
+	return errs.New("locations differing only in case: %s", strings.Join(collisions, "; "))
+}
+
+// Fingerprint returns a stable hash of the buckets and the committed files,
+// including their contents and metadata.
+func (rfs *RemoteFilesystem) Fingerprint() string {
+	h := sha256.New()
+	writeString := func(s string) {
+		_ = binary.Write(h, binary.BigEndian, uint64(len(s)))
+		_, _ = io.WriteString(h, s)
+	}
+
+	buckets := make([]string, 0, len(rfs.buckets))
+	for bucket := range rfs.buckets {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+
+	writeString("buckets")
+	for _, bucket := range buckets {
+		writeString(bucket)
+	}
+
+	writeString("files")
+	for _, file := range rfs.Files() {
+		writeString(file.Loc)
+		writeString(file.Contents)
+
+		keys := make([]string, 0, len(file.Metadata))
+		for key := range file.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		_ = binary.Write(h, binary.BigEndian, uint64(len(keys)))
+		for _, key := range keys {
+			writeString(key)
+			writeString(file.Metadata[key])
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Checksum returns the SHA-256 checksum of the contents stored for the file.
+func (rfs *RemoteFilesystem) Checksum(loc ulloc.Location) ([sha256.Size]byte, error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	mf, ok := rfs.lookup(loc)
+	if !ok {
+		return [sha256.Size]byte{}, errs.New("file does not exist %q", loc)
+	}
+	return mf.checksum, nil
+}
+
+// Truncated returns whether the commit of the file lost some of its contents.
+func (rfs *RemoteFilesystem) Truncated(loc ulloc.Location) (bool, error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	mf, ok := rfs.lookup(loc)
+	if !ok {
+		return false, errs.New("file does not exist %q", loc)
+	}
+	return mf.truncated, nil
+}
+
+// Pending returns the files of the pending uploads.
+func (rfs *RemoteFilesystem) Pending() (files []File) {
 	for loc, mh := range rfs.pending {
 		for _, h := range mh {
 			files = append(files, File{
@@ -82,7 +466,8 @@ func (rfs *remoteFilesystem) Pending() (files []File) {
 	return files
 }
 
-func (rfs *remoteFilesystem) Close() error {
+// Close implements ulfs.FilesystemRemote.
+func (rfs *RemoteFilesystem) Close() error {
 	return nil
 }
 
@@ -98,90 +483,279 @@ func newMultiReadHandle(contents string) ulfs.MultiReadHandle {
 	})
 }
 
-func (rfs *remoteFilesystem) Open(ctx context.Context, bucket, key string) (ulfs.MultiReadHandle, error) {
+// discardedReader fails reads of files whose contents were discarded.
+type discardedReader struct{ loc ulloc.Location }
+
+func (r discardedReader) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errs.New("contents of %q were discarded", r.loc)
+}
+
+func (r discardedReader) Close() error { return nil }
+
+func newDiscardedMultiReadHandle(loc ulloc.Location, size int64) ulfs.MultiReadHandle {
+	return ulfs.NewGenericMultiReadHandle(discardedReader{loc: loc}, ulfs.ObjectInfo{
+		ContentLength: size,
+	})
+}
+
+// Open opens the file at the location for reading.
+func (rfs *RemoteFilesystem) Open(ctx context.Context, bucket, key string) (_ ulfs.MultiReadHandle, err error) {
 	rfs.mu.Lock()
 	defer rfs.mu.Unlock()
 
-	loc := ulloc.NewRemote(bucket, key)
+	loc := rfs.location(bucket, key)
+	var size int64
+	defer func() { rfs.observe("open", loc, size, err) }()
+
+	if err := rfs.checkPermission(PermissionRead, loc); err != nil {
+		return nil, err
+	}
 
 	mf, ok := rfs.files[loc]
-	if !ok {
+	if !ok || mf.deleteMarker || rfs.gone(mf) {
 		return nil, errs.New("file does not exist %q", loc)
 	}
+	if mf.encryption.Algorithm != "" && rfs.serverSideEncryption(ctx) != mf.encryption {
+		return nil, errs.New("file %q requires server-side encryption key", loc)
+	}
+
+	if mf.discarded {
+		size = mf.length
+		return newDiscardedMultiReadHandle(loc, mf.length), nil
+	}
+
+	contents := mf.contents
+	if rfs.corruptDownloads && len(contents) > 0 {
+		corrupted := []byte(contents)
+		corrupted[0] ^= 0xFF
+		contents = string(corrupted)
+	}
 
-	return newMultiReadHandle(mf.contents), nil
+	size = int64(len(contents))
+	return newMultiReadHandle(contents), nil
 }
 
-func (rfs *remoteFilesystem) Create(ctx context.Context, bucket, key string, opts *ulfs.CreateOptions) (_ ulfs.MultiWriteHandle, err error) {
+// Create starts an upload to the location.
+func (rfs *RemoteFilesystem) Create(ctx context.Context, bucket, key string, opts *ulfs.CreateOptions) (_ ulfs.MultiWriteHandle, err error) {
+	wh, err := rfs.create(ctx, bucket, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &memMultiWriteHandle{
+		GenericMultiWriteHandle: ulfs.NewGenericMultiWriteHandle(wh),
+		wh:                      wh,
+	}, nil
+}
+
+// CommittedLocationReporter is implemented by the write handles returned by
+// Create to report where the upload was committed, which differs from the
+// requested location when keys are assigned by the server, see
+// WithAssignedKeySuffix.
+type CommittedLocationReporter interface {
+	CommittedLocation() (ulloc.Location, bool)
+}
+
+type memMultiWriteHandle struct {
+	*ulfs.GenericMultiWriteHandle
+	wh *memWriteHandle
+}
+
+// CommittedLocation returns the location of the committed upload and whether
+// it was committed.
+func (h *memMultiWriteHandle) CommittedLocation() (ulloc.Location, bool) {
+	h.wh.rfs.mu.Lock()
+	defer h.wh.rfs.mu.Unlock()
+
+	return h.wh.loc, h.wh.committed
+}
+
+func (rfs *RemoteFilesystem) create(ctx context.Context, bucket, key string, opts *ulfs.CreateOptions) (_ *memWriteHandle, err error) {
 	rfs.mu.Lock()
 	defer rfs.mu.Unlock()
 
-	loc := ulloc.NewRemote(bucket, key)
+	loc := rfs.location(bucket, key)
+	defer func() { rfs.observe("create", loc, 0, err) }()
 
-	if _, ok := rfs.buckets[bucket]; !ok {
+	if err := rfs.checkWritable("create", loc); err != nil {
+		return nil, err
+	}
+	if err := rfs.checkPermission(PermissionWrite, loc); err != nil {
+		return nil, err
+	}
+
+	mb, ok := rfs.buckets[bucket]
+	if !ok {
 		return nil, errs.New("bucket %q does not exist", bucket)
 	}
 
+	retention, ok := retentionFromContext(ctx)
+	if !ok && mb.defaultRetention.Enabled() {
+		retention = Retention{
+			Mode:        mb.defaultRetention.Mode,
+			RetainUntil: rfs.now().Add(mb.defaultRetention.Period),
+		}
+	}
+
 	var metadata map[string]string
 	expires := time.Time{}
 	if opts != nil {
 		expires = opts.Expires
-		metadata = opts.Metadata
+		metadata = copyMetadata(opts.Metadata)
 	}
 
 	rfs.created++
+	created := rfs.created
+	if rfs.createdClock != nil {
+		created = rfs.createdClock().Unix()
+	}
+
 	wh := &memWriteHandle{
-		loc:      loc,
-		rfs:      rfs,
-		cre:      rfs.created,
-		expires:  expires,
-		metadata: metadata,
+		ctx:        ctx,
+		loc:        loc,
+		rfs:        rfs,
+		cre:        created,
+		expires:    expires,
+		metadata:   metadata,
+		encryption: rfs.serverSideEncryption(ctx),
+		retention:  retention,
+	}
+	if rfs.discardContents {
+		wh.discard = true
+		wh.hash = sha256.New()
 	}
 
 	rfs.pending[loc] = append(rfs.pending[loc], wh)
 
-	return ulfs.NewGenericMultiWriteHandle(wh), nil
+	return wh, nil
 }
 
-func (rfs *remoteFilesystem) Move(ctx context.Context, oldbucket, oldkey string, newbucket, newkey string) error {
+// Move moves the file to the new location.
+func (rfs *RemoteFilesystem) Move(ctx context.Context, oldbucket, oldkey string, newbucket, newkey string) (err error) {
 	rfs.mu.Lock()
 	defer rfs.mu.Unlock()
 
 	source := ulloc.NewRemote(oldbucket, oldkey)
 	dest := ulloc.NewRemote(newbucket, newkey)
+	defer func() { rfs.observe("move", source, 0, err) }()
+
+	if err := rfs.checkWritable("move", source); err != nil {
+		return err
+	}
+	if err := rfs.checkPermission(PermissionRead|PermissionDelete, source); err != nil {
+		return err
+	}
+	if err := rfs.checkPermission(PermissionWrite, dest); err != nil {
+		return err
+	}
 
-	mf, ok := rfs.files[source]
+	mf, ok := rfs.lookup(source)
 	if !ok {
 		return errs.New("file does not exist %q", source)
 	}
-	delete(rfs.files, source)
-	rfs.files[dest] = mf
+	if err := rfs.checkLocked(source); err != nil {
+		return err
+	}
+	if err := rfs.checkLocked(dest); err != nil {
+		return err
+	}
+	if versioning := rfs.buckets[oldbucket].versioning; versioning != Unversioned {
+		rfs.removeVersioned(source, versioning)
+	} else {
+		delete(rfs.files, source)
+		delete(rfs.versions, source)
+	}
+	rfs.storeFile(dest, mf)
 	return nil
 }
 
-func (rfs *remoteFilesystem) Copy(ctx context.Context, oldbucket, oldkey string, newbucket, newkey string) error {
+// Copy copies the file to the new location.
+func (rfs *RemoteFilesystem) Copy(ctx context.Context, oldbucket, oldkey string, newbucket, newkey string) (err error) {
 	rfs.mu.Lock()
 	defer rfs.mu.Unlock()
 
 	source := ulloc.NewRemote(oldbucket, oldkey)
 	dest := ulloc.NewRemote(newbucket, newkey)
+	defer func() { rfs.observe("copy", source, 0, err) }()
+
+	if err := rfs.checkWritable("copy", source); err != nil {
+		return err
+	}
+	if err := rfs.checkPermission(PermissionRead, source); err != nil {
+		return err
+	}
+	if err := rfs.checkPermission(PermissionWrite, dest); err != nil {
+		return err
+	}
 
-	mf, ok := rfs.files[source]
+	mf, ok := rfs.lookup(source)
 	if !ok {
 		return errs.New("file does not exist %q", source)
 	}
-	rfs.files[dest] = mf
+	if err := rfs.checkLocked(dest); err != nil {
+		return err
+	}
+	rfs.storeFile(dest, mf)
 	return nil
 }
 
-func (rfs *remoteFilesystem) Remove(ctx context.Context, bucket, key string, opts *ulfs.RemoveOptions) error {
+// SetMetadata replaces the custom metadata of the existing file without
+// rewriting its contents.
+func (rfs *RemoteFilesystem) SetMetadata(ctx context.Context, loc ulloc.Location, metadata map[string]string) (err error) {
 	rfs.mu.Lock()
 	defer rfs.mu.Unlock()
 
-	loc := ulloc.NewRemote(bucket, key)
+	defer func() { rfs.observe("set metadata", loc, 0, err) }()
+
+	if err := rfs.checkWritable("set metadata", loc); err != nil {
+		return err
+	}
+	if err := rfs.checkPermission(PermissionWrite, loc); err != nil {
+		return err
+	}
+
+	mf, ok := rfs.lookup(loc)
+	if !ok || mf.expired(rfs.now()) {
+		return errs.New("file does not exist %q", loc)
+	}
+	mf.metadata = copyMetadata(metadata)
+	rfs.files[loc] = mf
+	return nil
+}
+
+// Remove removes the file, or the pending uploads when opts.Pending is set.
+func (rfs *RemoteFilesystem) Remove(ctx context.Context, bucket, key string, opts *ulfs.RemoveOptions) (err error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	loc := rfs.location(bucket, key)
+	defer func() { rfs.observe("remove", loc, 0, err) }()
+
+	if err := rfs.checkWritable("remove", loc); err != nil {
+		return err
+	}
+	if err := rfs.checkPermission(PermissionDelete, loc); err != nil {
+		return err
+	}
 
 	if opts == nil || !opts.Pending {
-		delete(rfs.files, loc)
+		if err := rfs.checkLocked(loc); err != nil {
+			return err
+		}
+		bucket, _, _ := loc.RemoteParts()
+		if versioning := rfs.buckets[bucket].versioning; versioning != Unversioned {
+			rfs.removeVersioned(loc, versioning)
+		} else if mf, ok := rfs.files[loc]; ok && rfs.deleteGrace > 0 {
+			// files already in their delete grace period keep their removal
+			// time, so that removing them again, like a retried rm, doesn't
+			// end or extend the grace period.
+			if !mf.removed() {
+				mf.deleted = rfs.now()
+				rfs.files[loc] = mf
+			}
+		} else {
+			delete(rfs.files, loc)
+			delete(rfs.versions, loc)
+		}
 	} else {
 		// TODO: Remove needs an API that understands that multiple pending files may exist
 		delete(rfs.pending, loc)
@@ -189,48 +763,485 @@ func (rfs *remoteFilesystem) Remove(ctx context.Context, bucket, key string, opt
 	return nil
 }
 
-func (rfs *remoteFilesystem) List(ctx context.Context, bucket, key string, opts *ulfs.ListOptions) ulfs.ObjectIterator {
+// RemoveMany removes the files at the locations, like a batch delete. Unlike
+// Remove, it reports an error for locations without a file. It returns the
+// number of removed files and the errors for the locations that failed.
+func (rfs *RemoteFilesystem) RemoveMany(ctx context.Context, locs []ulloc.Location) (removed int, failures []error) {
+	for _, loc := range locs {
+		bucket, key, ok := loc.RemoteParts()
+		if !ok {
+			failures = append(failures, errs.New("location %q is not remote", loc))
+			continue
+		}
+		if !rfs.exists(bucket, key) {
+			failures = append(failures, errs.New("file does not exist %q", loc))
+			continue
+		}
+		if err := rfs.Remove(ctx, bucket, key, nil); err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		removed++
+	}
+	return removed, failures
+}
+
+// exists returns whether there is a file at the bucket and key.
+func (rfs *RemoteFilesystem) exists(bucket, key string) bool {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	_, ok := rfs.lookup(rfs.location(bucket, key))
+	return ok
+}
+
+// RemoveBucket removes the bucket. Unless force is set, the bucket must not
+// contain any files or pending uploads. It returns the number of files
+// removed, even when it fails partway.
+func (rfs *RemoteFilesystem) RemoveBucket(ctx context.Context, name string, force bool) (deleted int, err error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	defer func() { rfs.observe("remove bucket", ulloc.NewRemote(name, ""), 0, err) }()
+
+	if err := rfs.checkWritable("remove bucket", ulloc.NewRemote(name, "")); err != nil {
+		return 0, err
+	}
+	if err := rfs.checkPermission(PermissionDelete, ulloc.NewRemote(name, "")); err != nil {
+		return 0, err
+	}
+
+	if _, ok := rfs.buckets[name]; !ok {
+		return 0, errs.New("bucket %q does not exist", name)
+	}
+
+	rfs.purgeGone(name)
+	locs, pending := rfs.bucketContents(name)
+
+	if !force {
+		if len(locs) > 0 || len(pending) > 0 {
+			return 0, errs.New("bucket %q is not empty", name)
+		}
+		delete(rfs.buckets, name)
+		return 0, nil
+	}
+	for _, loc := range locs {
+		if err := rfs.checkAllUnlocked(loc); err != nil {
+			return 0, err
+		}
+	}
+
+	sort.Slice(locs, func(i, j int) bool { return locs[i].Less(locs[j]) })
+	for _, loc := range locs {
+		if rfs.removeBucketErr != nil && deleted >= rfs.removeBucketErrAfter {
+			return deleted, rfs.removeBucketErr
+		}
+		delete(rfs.files, loc)
+		delete(rfs.versions, loc)
+		deleted++
+	}
+	for _, loc := range pending {
+		delete(rfs.pending, loc)
+	}
+
+	delete(rfs.buckets, name)
+	return deleted, nil
+}
+
+// IsBucketEmpty returns whether the bucket has no files and no pending uploads.
+func (rfs *RemoteFilesystem) IsBucketEmpty(name string) (bool, error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	if _, ok := rfs.buckets[name]; !ok {
+		return false, errs.New("bucket %q does not exist", name)
+	}
+
+	locs, pending := rfs.bucketContents(name)
+	return len(locs) == 0 && len(pending) == 0, nil
+}
+
+// ProjectBytes returns the bytes stored across all buckets, treating them as
+// one project, along with the bytes stored in each bucket. Noncurrent
+// versions count towards the usage, while delete markers and expired objects
+// do not.
+func (rfs *RemoteFilesystem) ProjectBytes() (total int64, byBucket map[string]int64) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	byBucket = make(map[string]int64, len(rfs.buckets))
+	for name := range rfs.buckets {
+		byBucket[name] = 0
+	}
+
+	add := func(loc ulloc.Location, mf memFileData) {
+		if mf.expired(rfs.now()) || mf.removed() {
+			return
+		}
+		bucket, _, _ := loc.RemoteParts()
+		byBucket[bucket] += mf.size()
+		total += mf.size()
+	}
+	for loc, mf := range rfs.files {
+		add(loc, mf)
+	}
+	for loc, versions := range rfs.versions {
+		for _, mf := range versions {
+			add(loc, mf)
+		}
+	}
+
+	return total, byBucket
+}
+
+// bucketContents returns the locations of the files and the pending uploads
+// in the bucket.
+func (rfs *RemoteFilesystem) bucketContents(name string) (locs, pending []ulloc.Location) {
+	for loc, mf := range rfs.files {
+		if bucket, _, _ := loc.RemoteParts(); bucket == name && !rfs.gone(mf) {
+			locs = append(locs, loc)
+		}
+	}
+	for loc := range rfs.pending {
+		if bucket, _, _ := loc.RemoteParts(); bucket == name {
+			pending = append(pending, loc)
+		}
+	}
+	return locs, pending
+}
+
+// purgeGone deletes the files of the bucket that are gone, see gone.
+func (rfs *RemoteFilesystem) purgeGone(name string) {
+	for loc, mf := range rfs.files {
+		if bucket, _, _ := loc.RemoteParts(); bucket == name && rfs.gone(mf) {
+			delete(rfs.files, loc)
+			delete(rfs.versions, loc)
+		}
+	}
+}
+
+// List lists the files, or the pending uploads when opts.Pending is set,
+// under the location.
+func (rfs *RemoteFilesystem) List(ctx context.Context, bucket, key string, opts *ulfs.ListOptions) ulfs.ObjectIterator {
 	rfs.mu.Lock()
 	defer rfs.mu.Unlock()
 
 	prefix := ulloc.NewRemote(bucket, key)
 
+	if err := rfs.checkPermission(PermissionList, prefix); err != nil {
+		rfs.observe("list", prefix, 0, err)
+		return &objectInfoIterator{err: err}
+	}
+
 	if opts != nil && opts.Pending {
+		defer rfs.observe("list", prefix, 0, nil)
 		return rfs.listPending(ctx, prefix, opts)
 	}
 
+	infos, err := rfs.listObjects(prefix, &ListObjectsOptions{
+		Recursive: opts != nil && opts.Recursive,
+	})
+	rfs.shuffle(infos)
+	rfs.observe("list", prefix, 0, err)
+	return &objectInfoIterator{infos: infos, err: err}
+}
+
+// ListObjectsOptions describes options to ListObjects.
+type ListObjectsOptions struct {
+	Recursive bool
+
+	// ModifiedSince, when set, excludes objects created at or before it.
+	ModifiedSince time.Time
+
+	// MaxKeys, when positive, limits the number of returned objects. When
+	// the results are truncated, a continuation token is returned.
+	MaxKeys int
+	// ContinuationToken resumes a truncated listing.
+	ContinuationToken string
+
+	// IncludeDeleteMarkers includes files removed during the delete grace
+	// period as entries flagged with IsDeleteMarker.
+	IncludeDeleteMarkers bool
+
+	// Suffix, when set, only includes objects with keys ending with it.
+	// Without Recursive, prefixes are only included when they contain such
+	// objects.
+	Suffix string
+
+	// ExcludePrefixObject excludes the object whose key is exactly the
+	// prefix, like S3 does, instead of listing it like Storj does.
+	ExcludePrefixObject bool
+}
+
+// ListObjects lists the objects under the remote prefix. When the listing is
+// truncated by MaxKeys, it returns a token that continues it.
+func (rfs *RemoteFilesystem) ListObjects(ctx context.Context, prefix ulloc.Location, opts *ListObjectsOptions) (_ []ulfs.ObjectInfo, token string, err error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	defer func() { rfs.observe("list", prefix, 0, err) }()
+
+	if err := ValidateListPrefix(prefix); err != nil {
+		return nil, "", err
+	}
+	if err := rfs.checkPermission(PermissionList, prefix); err != nil {
+		return nil, "", err
+	}
+	if opts == nil {
+		opts = &ListObjectsOptions{}
+	}
+	maxKeys, err := rfs.listLimit(opts.MaxKeys)
+	if err != nil {
+		return nil, "", err
+	}
+
+	infos, err := rfs.listObjects(prefix, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if opts.ContinuationToken != "" {
+		start := sort.Search(len(infos), func(i int) bool {
+			return infos[i].Loc.Loc() > opts.ContinuationToken
+		})
+		infos = infos[start:]
+	}
+	if maxKeys > 0 && len(infos) > maxKeys {
+		infos = infos[:maxKeys]
+		token = infos[len(infos)-1].Loc.Loc()
+	}
+
+	rfs.shuffle(infos)
+
+	return infos, token, nil
+}
+
+// shuffle reorders the infos deterministically by the shuffle seed when
+// listings are shuffled.
+func (rfs *RemoteFilesystem) shuffle(infos []ulfs.ObjectInfo) {
+	if rfs.shuffleListObjects {
+		rng := rand.New(rand.NewSource(rfs.shuffleSeed))
+		rng.Shuffle(len(infos), func(i, j int) { infos[i], infos[j] = infos[j], infos[i] })
+	}
+}
+
+// ListAllByBucket recursively lists the objects of every bucket, grouped by
+// bucket name. Buckets without objects are included with no objects.
+func (rfs *RemoteFilesystem) ListAllByBucket(ctx context.Context) (_ map[string][]ulfs.ObjectInfo, err error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	byBucket := make(map[string][]ulfs.ObjectInfo, len(rfs.buckets))
+	for name := range rfs.buckets {
+		prefix := ulloc.NewRemote(name, "")
+		if err := rfs.checkPermission(PermissionList, prefix); err != nil {
+			rfs.observe("list", prefix, 0, err)
+			return nil, err
+		}
+
+		infos, err := rfs.listObjects(prefix, &ListObjectsOptions{Recursive: true})
+		rfs.observe("list", prefix, 0, err)
+		if err != nil {
+			return nil, err
+		}
+		byBucket[name] = infos
+	}
+
+	return byBucket, nil
+}
+
+// PrefixLastModified returns the latest created time of the objects under the
+// remote prefix, or the zero time when there are none. Without recursive,
+// only the objects directly under the prefix are considered.
+func (rfs *RemoteFilesystem) PrefixLastModified(ctx context.Context, prefix ulloc.Location, recursive bool) (_ time.Time, err error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	defer func() { rfs.observe("list", prefix, 0, err) }()
+
+	if err := ValidateListPrefix(prefix); err != nil {
+		return time.Time{}, err
+	}
+	if err := rfs.checkPermission(PermissionList, prefix); err != nil {
+		return time.Time{}, err
+	}
+
+	infos, err := rfs.listObjects(prefix, &ListObjectsOptions{Recursive: recursive})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var last time.Time
+	for _, info := range infos {
+		if !info.IsPrefix && info.Created.After(last) {
+			last = info.Created
+		}
+	}
+	return last, nil
+}
+
+// ValidateListPrefix returns an error unless the prefix is a remote location
+// scoped to a single bucket, either a bucket root or a key prefix in it.
+func ValidateListPrefix(prefix ulloc.Location) error {
+	bucket, _, ok := prefix.RemoteParts()
+	if !ok {
+		return errs.New("prefix %q is not remote", prefix)
+	}
+	if strings.ContainsAny(bucket, "/*?") {
+		return errs.New("prefix %q is not scoped to a single bucket", prefix)
+	}
+	return nil
+}
+
+// listLimit validates the requested number of keys against maxListLimit and
+// returns the number of keys to list, where zero means no limit.
+func (rfs *RemoteFilesystem) listLimit(maxKeys int) (int, error) {
+	if rfs.maxListLimit <= 0 {
+		return maxKeys, nil
+	}
+	if maxKeys > rfs.maxListLimit && rfs.rejectListLimit {
+		return 0, errs.New("list limit %d exceeds the maximum of %d", maxKeys, rfs.maxListLimit)
+	}
+	if maxKeys <= 0 || maxKeys > rfs.maxListLimit {
+		return rfs.maxListLimit, nil
+	}
+	return maxKeys, nil
+}
+
+// listObjects returns the objects under the prefix. When the listing reaches a
+// location with a list error, it returns the objects before it and the error.
+func (rfs *RemoteFilesystem) listObjects(prefix ulloc.Location, opts *ListObjectsOptions) (_ []ulfs.ObjectInfo, err error) {
 	prefixDir := prefix.AsDirectoryish()
 
 	var infos []ulfs.ObjectInfo
 	for loc, mf := range rfs.files {
-		if (loc.HasPrefix(prefixDir) || loc == prefix) && !mf.expired() {
+		if (loc.HasPrefix(prefixDir) || loc == prefix) && !mf.expired(rfs.now()) {
+			if loc == prefix && opts.ExcludePrefixObject {
+				continue
+			}
+			if mf.removed() && (!opts.IncludeDeleteMarkers || rfs.gone(mf)) {
+				continue
+			}
+			if !strings.HasSuffix(loc.Loc(), opts.Suffix) {
+				continue
+			}
+			created := createdTime(mf.created)
+			if !opts.ModifiedSince.IsZero() && !created.After(opts.ModifiedSince) {
+				continue
+			}
+			if mf.removed() {
+				infos = append(infos, ulfs.ObjectInfo{
+					Loc:            loc,
+					IsDeleteMarker: true,
+					Created:        mf.deleted,
+				})
+				continue
+			}
 			infos = append(infos, ulfs.ObjectInfo{
-				Loc:     loc,
-				Created: time.Unix(mf.created, 0),
-				Expires: mf.expires,
+				Loc:                 loc,
+				Created:             created,
+				Expires:             mf.expires,
+				Metadata:            copyMetadata(mf.metadata),
+				EncryptionAlgorithm: mf.encryption.Algorithm,
 			})
 		}
 	}
 
 	sort.Sort(objectInfos(infos))
 
-	if opts == nil || !opts.Recursive {
+	for i, info := range infos {
+		if listErr, ok := rfs.listErrors[info.Loc]; ok {
+			infos, err = infos[:i], listErr
+			break
+		}
+	}
+
+	if !opts.Recursive {
 		infos = collapseObjectInfos(prefix, infos)
 	}
 
-	return &objectInfoIterator{infos: infos}
+	return infos, err
+}
+
+func (rfs *RemoteFilesystem) listPending(ctx context.Context, prefix ulloc.Location, opts *ulfs.ListOptions) ulfs.ObjectIterator {
+	return &objectInfoIterator{infos: rfs.listUploads(prefix, &ListUploadsOptions{
+		Recursive: opts != nil && opts.Recursive,
+	})}
 }
 
-func (rfs *remoteFilesystem) listPending(ctx context.Context, prefix ulloc.Location, opts *ulfs.ListOptions) ulfs.ObjectIterator {
+// ListUploadsOptions describes options to ListUploads.
+type ListUploadsOptions struct {
+	Recursive bool
+
+	// OlderThan, when set, only includes uploads created before now minus
+	// the duration. Without a clock from WithClock or WithCreatedClock, ages
+	// are counted in uploads created since instead of in time, see
+	// createdNow.
+	OlderThan time.Duration
+}
+
+// ListUploads lists the pending uploads under the remote prefix.
+func (rfs *RemoteFilesystem) ListUploads(ctx context.Context, prefix ulloc.Location, opts *ListUploadsOptions) (_ []ulfs.ObjectInfo, err error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	defer func() { rfs.observe("list", prefix, 0, err) }()
+
+	if err := ValidateListPrefix(prefix); err != nil {
+		return nil, err
+	}
+	if err := rfs.checkPermission(PermissionList, prefix); err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &ListUploadsOptions{}
+	}
+
+	return rfs.listUploads(prefix, opts), nil
+}
+
+// OrphanedUploads returns the locations of the pending uploads in all buckets
+// that were created more than olderThan ago and were neither committed nor
+// aborted since. A location is returned once even with multiple such uploads.
+// Ages are computed like for ListUploadsOptions.OlderThan.
+func (rfs *RemoteFilesystem) OrphanedUploads(olderThan time.Duration) []ulloc.Location {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	cutoff := rfs.createdNow().Add(-olderThan)
+
+	var locs []ulloc.Location
+	for loc, whs := range rfs.pending {
+		for _, wh := range whs {
+			if createdTime(wh.cre).Before(cutoff) {
+				locs = append(locs, loc)
+				break
+			}
+		}
+	}
+	sort.Slice(locs, func(i, j int) bool { return locs[i].Less(locs[j]) })
+	return locs
+}
+
+func (rfs *RemoteFilesystem) listUploads(prefix ulloc.Location, opts *ListUploadsOptions) []ulfs.ObjectInfo {
 	prefixDir := prefix.AsDirectoryish()
 
+	var cutoff time.Time
+	if opts.OlderThan > 0 {
+		cutoff = rfs.createdNow().Add(-opts.OlderThan)
+	}
+
 	var infos []ulfs.ObjectInfo
 	for loc, whs := range rfs.pending {
 		if loc.HasPrefix(prefixDir) || loc == prefix {
 			for _, wh := range whs {
+				created := createdTime(wh.cre)
+				if !cutoff.IsZero() && !created.Before(cutoff) {
+					continue
+				}
 				infos = append(infos, ulfs.ObjectInfo{
 					Loc:     loc,
-					Created: time.Unix(wh.cre, 0),
+					Created: created,
 				})
 			}
 		}
@@ -238,34 +1249,36 @@ func (rfs *remoteFilesystem) listPending(ctx context.Context, prefix ulloc.Locat
 
 	sort.Sort(objectInfos(infos))
 
-	if opts == nil || !opts.Recursive {
+	if !opts.Recursive {
 		infos = collapseObjectInfos(prefix, infos)
 	}
 
-	return &objectInfoIterator{infos: infos}
+	return infos
 }
 
-func (rfs *remoteFilesystem) Stat(ctx context.Context, bucket, key string) (*ulfs.ObjectInfo, error) {
+// Stat returns the object info of the file at the location.
+func (rfs *RemoteFilesystem) Stat(ctx context.Context, bucket, key string) (_ *ulfs.ObjectInfo, err error) {
 	rfs.mu.Lock()
 	defer rfs.mu.Unlock()
 
 	loc := ulloc.NewRemote(bucket, key)
+	defer func() { rfs.observe("stat", loc, 0, err) }()
 
-	mf, ok := rfs.files[loc]
+	if err := rfs.checkPermission(PermissionRead, loc); err != nil {
+		return nil, err
+	}
+
+	mf, ok := rfs.lookup(loc)
 	if !ok {
 		return nil, errs.New("file does not exist: %q", loc.Loc())
 	}
 
-	if mf.expired() {
+	if mf.expired(rfs.now()) {
 		return nil, errs.New("file does not exist: %q", loc.Loc())
 	}
 
-	return &ulfs.ObjectInfo{
-		Loc:           loc,
-		Created:       time.Unix(mf.created, 0),
-		Expires:       mf.expires,
-		ContentLength: int64(len(mf.contents)),
-	}, nil
+	info := mf.objectInfo(loc)
+	return &info, nil
 }
 
 //
@@ -273,19 +1286,37 @@ func (rfs *remoteFilesystem) Stat(ctx context.Context, bucket, key string) (*ulf
 //
 
 type memWriteHandle struct {
-	buf      []byte
-	loc      ulloc.Location
-	rfs      *remoteFilesystem
-	cre      int64
-	expires  time.Time
-	metadata map[string]string
-	done     bool
+	ctx        context.Context
+	buf        []byte
+	loc        ulloc.Location
+	rfs        *RemoteFilesystem
+	cre        int64
+	expires    time.Time
+	metadata   map[string]string
+	encryption ServerSideEncryption
+	retention  Retention
+	parts      []memPart
+	done       bool
+	committed  bool
+
+	// discard makes the handle only count and hash the written data. Data
+	// written past the hashed length, like parts uploaded out of order, is
+	// held in early until the data before it is written.
+	discard bool
+	length  int64
+	hash    hash.Hash
+	hashed  int64
+	early   map[int64][]byte
 }
 
 func (b *memWriteHandle) WriteAt(p []byte, off int64) (int, error) {
 	if b.done {
 		return 0, errs.New("write to closed handle")
 	}
+	if b.discard {
+		b.discardAt(p, off)
+		return len(p), nil
+	}
 	end := int64(len(p)) + off
 	if grow := end - int64(len(b.buf)); grow > 0 {
 		b.buf = append(b.buf, make([]byte, grow)...)
@@ -293,33 +1324,147 @@ func (b *memWriteHandle) WriteAt(p []byte, off int64) (int, error) {
 	return copy(b.buf[off:], p), nil
 }
 
-func (b *memWriteHandle) Commit() error {
+func (b *memWriteHandle) Commit() (err error) {
+	if err := b.finalize(); err != nil {
+		return err
+	}
+
 	b.rfs.mu.Lock()
 	defer b.rfs.mu.Unlock()
 
+	defer func() { b.rfs.observe("commit", b.loc, b.size(), err) }()
+
+	if err := b.ctx.Err(); err != nil {
+		return err
+	}
+	if err := b.rfs.checkWritable("commit", b.loc); err != nil {
+		return err
+	}
 	if err := b.close(); err != nil {
 		return err
 	}
+	if b.rfs.assignKeySuffix != nil {
+		bucket, key, _ := b.loc.RemoteParts()
+		b.loc = ulloc.NewRemote(bucket, key+b.rfs.assignKeySuffix())
+	}
+	if err := b.rfs.checkLocked(b.loc); err != nil {
+		return err
+	}
+	b.committed = true
+	if b.rfs.loseCommits {
+		return nil
+	}
 
-	b.rfs.files[b.loc] = memFileData{
-		contents: string(b.buf),
-		created:  b.cre,
-		expires:  b.expires,
-		metadata: b.metadata,
+	metadata := b.metadata
+	if _, ok := metadata[ContentTypeMetadataKey]; !ok && b.rfs.sniffContentType && !b.discard {
+		metadata = make(map[string]string, len(b.metadata)+1)
+		for k, v := range b.metadata {
+			metadata[k] = v
+		}
+		metadata[ContentTypeMetadataKey] = http.DetectContentType(b.buf)
+	}
+
+	contents := b.buf
+	truncated := b.rfs.truncateCommits && int64(len(contents)) > b.rfs.truncatedLength
+	if truncated {
+		contents = contents[:b.rfs.truncatedLength]
+	}
+
+	mf := memFileData{
+		contents:   string(contents),
+		created:    b.cre,
+		expires:    b.expires,
+		metadata:   metadata,
+		encryption: b.encryption,
+		retention:  b.retention,
+		parts:      b.parts,
+		checksum:   sha256.Sum256(contents),
+		truncated:  truncated,
+	}
+	if b.discard {
+		mf.discarded = true
+		mf.length = b.length
+		copy(mf.checksum[:], b.hash.Sum(nil))
+	}
+	b.rfs.storeFile(b.loc, mf)
+
+	if b.rfs.commitProgress != nil {
+		b.rfs.commitProgress(b.loc, b.size(), b.size())
 	}
 
 	return nil
 }
 
-func (b *memWriteHandle) Abort() error {
+// discardAt counts and hashes the data written at the offset, holding it until
+// all the data before it is hashed.
+func (b *memWriteHandle) discardAt(p []byte, off int64) {
+	if end := off + int64(len(p)); end > b.length {
+		b.length = end
+	}
+	if off > b.hashed {
+		if b.early == nil {
+			b.early = make(map[int64][]byte)
+		}
+		b.early[off] = append([]byte(nil), p...)
+		return
+	}
+	if skip := b.hashed - off; skip < int64(len(p)) {
+		_, _ = b.hash.Write(p[skip:])
+		b.hashed += int64(len(p)) - skip
+	}
+	for {
+		next, ok := b.early[b.hashed]
+		if !ok {
+			return
+		}
+		delete(b.early, b.hashed)
+		_, _ = b.hash.Write(next)
+		b.hashed += int64(len(next))
+	}
+}
+
+// size returns the number of bytes written to the handle.
+func (b *memWriteHandle) size() int64 {
+	if b.discard {
+		return b.length
+	}
+	return int64(len(b.buf))
+}
+
+// finalize simulates a slow commit by sleeping for the configured commit
+// delay and reporting the progress, which only reaches the total once the
+// upload is stored.
+func (b *memWriteHandle) finalize() error {
+	steps := b.rfs.commitSteps
+	if steps <= 0 {
+		steps = 1
+	}
+	total := b.size()
+
+	for step := 0; step < steps; step++ {
+		if b.rfs.commitProgress != nil {
+			b.rfs.commitProgress(b.loc, total*int64(step)/int64(steps), total)
+		}
+		if b.rfs.commitDelay > 0 && !sync2.Sleep(b.ctx, b.rfs.commitDelay/time.Duration(steps)) {
+			return b.ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *memWriteHandle) Abort() (err error) {
 	b.rfs.mu.Lock()
 	defer b.rfs.mu.Unlock()
 
+	defer func() { b.rfs.observe("abort", b.loc, 0, err) }()
+
+	// the pending upload is dropped even with a canceled context, because
+	// the handle can't be aborted again afterwards.
 	if err := b.close(); err != nil {
 		return err
 	}
 
-	return nil
+	return b.ctx.Err()
 }
 
 func (b *memWriteHandle) close() error {
@@ -352,6 +1497,7 @@ func (b *memWriteHandle) close() error {
 type objectInfoIterator struct {
 	infos   []ulfs.ObjectInfo
 	current ulfs.ObjectInfo
+	err     error
 }
 
 func (li *objectInfoIterator) Next() bool {
@@ -363,18 +1509,42 @@ func (li *objectInfoIterator) Next() bool {
 }
 
 func (li *objectInfoIterator) Err() error {
-	return nil
+	return li.err
 }
 
 func (li *objectInfoIterator) Item() ulfs.ObjectInfo {
 	return li.current
 }
 
+// ObjectInfoSortKey returns a key whose byte order is the order in which the
+// backend lists objects: by bucket name and then by object key, both compared
+// byte-wise like the primary key of the metabase objects table. Local files
+// sort before remote objects.
+//
+// This differs from the byte order of the location strings, e.g.
+// "sj://a/z" sorts before "sj://a-b/a" even though '-' sorts before '/'.
+func ObjectInfoSortKey(info ulfs.ObjectInfo) string {
+	if bucket, key, ok := info.Loc.RemoteParts(); ok {
+		return "\x01" + bucket + "\x00" + key
+	}
+	if path, ok := info.Loc.LocalParts(); ok {
+		return "\x00" + path
+	}
+	return ""
+}
+
+// objectInfos sorts by location, in the order of ObjectInfoSortKey without
+// building the keys, breaking ties by the created time.
 type objectInfos []ulfs.ObjectInfo
 
-func (ois objectInfos) Len() int               { return len(ois) }
-func (ois objectInfos) Swap(i int, j int)      { ois[i], ois[j] = ois[j], ois[i] }
-func (ois objectInfos) Less(i int, j int) bool { return ois[i].Loc.Less(ois[j].Loc) }
+func (ois objectInfos) Len() int          { return len(ois) }
+func (ois objectInfos) Swap(i int, j int) { ois[i], ois[j] = ois[j], ois[i] }
+func (ois objectInfos) Less(i int, j int) bool {
+	if ois[i].Loc != ois[j].Loc {
+		return ois[i].Loc.Less(ois[j].Loc)
+	}
+	return ois[i].Created.Before(ois[j].Created)
+}
 
 func collapseObjectInfos(prefix ulloc.Location, infos []ulfs.ObjectInfo) []ulfs.ObjectInfo {
 	collapsing := false
@@ -0,0 +1,1546 @@
+// Copyright (C) 2024 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ultest
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zeebo/errs"
+
+	"storj.io/common/testcontext"
+	"storj.io/storj/cmd/uplink/ulfs"
+	"storj.io/storj/cmd/uplink/ulloc"
+)
+
+func uploadFile(ctx context.Context, t *testing.T, rfs *RemoteFilesystem, bucket, key, contents string) {
+	rfs.ensureBucket(bucket)
+
+	mwh, err := rfs.Create(ctx, bucket, key, nil)
+	require.NoError(t, err)
+
+	wh, err := mwh.NextPart(ctx, -1)
+	require.NoError(t, err)
+
+	_, err = wh.Write([]byte(contents))
+	require.NoError(t, err)
+
+	require.NoError(t, wh.Commit())
+	require.NoError(t, mwh.Commit(ctx))
+}
+
+func readFile(ctx context.Context, rfs *RemoteFilesystem, bucket, key string) (string, error) {
+	mrh, err := rfs.Open(ctx, bucket, key)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = mrh.Close() }()
+
+	rh, err := mrh.NextPart(ctx, -1)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = rh.Close() }()
+
+	data, err := io.ReadAll(rh)
+	return string(data), err
+}
+
+func listLocations(ctx context.Context, rfs *RemoteFilesystem, bucket, key string, opts *ulfs.ListOptions) (locs []ulloc.Location, err error) {
+	iter := rfs.List(ctx, bucket, key, opts)
+	for iter.Next() {
+		locs = append(locs, iter.Item().Loc)
+	}
+	return locs, iter.Err()
+}
+
+func TestDeleteGracePeriod(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	now := time.Now()
+	rfs := newRemoteFilesystem()
+	rfs.now = func() time.Time { return now }
+	rfs.deleteGrace = time.Minute
+
+	uploadFile(ctx, t, rfs, "bucket", "file.txt", "contents")
+	require.NoError(t, rfs.Remove(ctx, "bucket", "file.txt", nil))
+
+	locs, err := listLocations(ctx, rfs, "bucket", "", &ulfs.ListOptions{Recursive: true})
+	require.NoError(t, err)
+	require.Empty(t, locs)
+	require.Empty(t, rfs.Files())
+
+	_, err = rfs.Stat(ctx, "bucket", "file.txt")
+	require.Error(t, err)
+
+	contents, err := readFile(ctx, rfs, "bucket", "file.txt")
+	require.NoError(t, err)
+	require.Equal(t, "contents", contents)
+
+	// removing the file again neither ends nor extends the grace period.
+	now = now.Add(30 * time.Second)
+	require.NoError(t, rfs.Remove(ctx, "bucket", "file.txt", nil))
+	_, err = readFile(ctx, rfs, "bucket", "file.txt")
+	require.NoError(t, err)
+
+	now = now.Add(30 * time.Second)
+
+	_, err = readFile(ctx, rfs, "bucket", "file.txt")
+	require.Error(t, err)
+}
+
+func TestDeleteGracePeriodExpiry(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	now := time.Now()
+	rfs := newRemoteFilesystem()
+	rfs.now = func() time.Time { return now }
+	rfs.deleteGrace = time.Minute
+
+	uploadFile(ctx, t, rfs, "bucket", "file.txt", "contents")
+	require.NoError(t, rfs.Remove(ctx, "bucket", "file.txt", nil))
+
+	empty, err := rfs.IsBucketEmpty("bucket")
+	require.NoError(t, err)
+	require.False(t, empty)
+
+	infos, _, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{IncludeDeleteMarkers: true})
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+
+	now = now.Add(time.Hour)
+
+	// the expired file is gone without anything reading it first.
+	empty, err = rfs.IsBucketEmpty("bucket")
+	require.NoError(t, err)
+	require.True(t, empty)
+
+	infos, _, err = rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{IncludeDeleteMarkers: true})
+	require.NoError(t, err)
+	require.Empty(t, infos)
+
+	// reads don't change the state.
+	_, err = readFile(ctx, rfs, "bucket", "file.txt")
+	require.Error(t, err)
+	require.Len(t, rfs.files, 1)
+
+	deleted, err := rfs.RemoveBucket(ctx, "bucket", false)
+	require.NoError(t, err)
+	require.Zero(t, deleted)
+	require.Empty(t, rfs.files)
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.normalizeKey = func(key string) string { return strings.TrimRight(key, "/") }
+
+	uploadFile(ctx, t, rfs, "bucket", "dir/file/", "contents")
+	require.Equal(t, []File{{Loc: "sj://bucket/dir/file", Contents: "contents"}}, rfs.Files())
+
+	contents, err := readFile(ctx, rfs, "bucket", "dir/file")
+	require.NoError(t, err)
+	require.Equal(t, "contents", contents)
+
+	contents, err = readFile(ctx, rfs, "bucket", "dir/file//")
+	require.NoError(t, err)
+	require.Equal(t, "contents", contents)
+
+	require.NoError(t, rfs.Remove(ctx, "bucket", "dir/file///", nil))
+	require.Empty(t, rfs.Files())
+}
+
+func TestOperationObserver(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	var ops []Operation
+	rfs := newRemoteFilesystem()
+	rfs.observers = append(rfs.observers, func(op Operation) { ops = append(ops, op) })
+
+	uploadFile(ctx, t, rfs, "bucket", "dir/file.txt", "contents")
+
+	_, err := listLocations(ctx, rfs, "bucket", "dir/", nil)
+	require.NoError(t, err)
+
+	_, err = rfs.Stat(ctx, "bucket", "missing")
+	require.Error(t, err)
+
+	require.Len(t, ops, 4)
+	require.Equal(t, Operation{Name: "create", Loc: ulloc.NewRemote("bucket", "dir/file.txt")}, ops[0])
+	require.Equal(t, Operation{Name: "commit", Loc: ulloc.NewRemote("bucket", "dir/file.txt"), Bytes: 8}, ops[1])
+	require.Equal(t, Operation{Name: "list", Loc: ulloc.NewRemote("bucket", "dir/")}, ops[2])
+	require.Equal(t, "stat", ops[3].Name)
+	require.Equal(t, ulloc.NewRemote("bucket", "missing"), ops[3].Loc)
+	require.Error(t, ops[3].Err)
+}
+
+func TestOperationRequestIDs(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	run := func(seed int64) (ids []string) {
+		rfs := newRemoteFilesystem()
+		cs := &callbackState{rfs: rfs}
+		WithRequestIDs(seed).fn(t, ctx, cs)
+		WithOperationObserver(func(op Operation) { ids = append(ids, op.RequestID) }).fn(t, ctx, cs)
+
+		uploadFile(ctx, t, rfs, "bucket", "file", "contents")
+		_, err := rfs.Stat(ctx, "bucket", "file")
+		require.NoError(t, err)
+		_, err = rfs.Stat(ctx, "bucket", "missing")
+		require.Error(t, err)
+		require.NoError(t, rfs.Remove(ctx, "bucket", "file", nil))
+		return ids
+	}
+
+	ids := run(1)
+	require.Len(t, ids, 5)
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		require.Len(t, id, 16)
+		require.False(t, seen[id], id)
+		seen[id] = true
+	}
+
+	require.Equal(t, ids, run(1))
+	require.NotEqual(t, ids, run(2))
+}
+
+func TestRemoveBucket(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	t.Run("Not Empty", func(t *testing.T) {
+		rfs := newRemoteFilesystem()
+		uploadFile(ctx, t, rfs, "bucket", "file.txt", "contents")
+
+		_, err := rfs.RemoveBucket(ctx, "bucket", false)
+		require.Error(t, err)
+		require.Len(t, rfs.Files(), 1)
+	})
+
+	t.Run("Force", func(t *testing.T) {
+		rfs := newRemoteFilesystem()
+		uploadFile(ctx, t, rfs, "bucket", "file1.txt", "contents")
+		uploadFile(ctx, t, rfs, "bucket", "file2.txt", "contents")
+		uploadFile(ctx, t, rfs, "other", "file.txt", "contents")
+
+		deleted, err := rfs.RemoveBucket(ctx, "bucket", true)
+		require.NoError(t, err)
+		require.Equal(t, 2, deleted)
+		require.Equal(t, []File{{Loc: "sj://other/file.txt", Contents: "contents"}}, rfs.Files())
+
+		_, err = rfs.Create(ctx, "bucket", "file.txt", nil)
+		require.Error(t, err)
+	})
+
+	t.Run("Partial Failure", func(t *testing.T) {
+		rfs := newRemoteFilesystem()
+		rfs.removeBucketErr = errs.New("injected failure")
+		rfs.removeBucketErrAfter = 2
+
+		uploadFile(ctx, t, rfs, "bucket", "file1.txt", "contents")
+		uploadFile(ctx, t, rfs, "bucket", "file2.txt", "contents")
+		uploadFile(ctx, t, rfs, "bucket", "file3.txt", "contents")
+		uploadFile(ctx, t, rfs, "bucket", "file4.txt", "contents")
+
+		deleted, err := rfs.RemoveBucket(ctx, "bucket", true)
+		require.ErrorIs(t, err, rfs.removeBucketErr)
+		require.Equal(t, 2, deleted)
+		require.Equal(t, []File{
+			{Loc: "sj://bucket/file3.txt", Contents: "contents"},
+			{Loc: "sj://bucket/file4.txt", Contents: "contents"},
+		}, rfs.Files())
+
+		uploadFile(ctx, t, rfs, "bucket", "file5.txt", "contents")
+		require.Len(t, rfs.Files(), 3)
+	})
+}
+
+func TestListObjectsModifiedSince(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "bucket", "old.txt", "contents")
+	uploadFile(ctx, t, rfs, "bucket", "dir/old.txt", "contents")
+
+	infos, _, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{Recursive: true})
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	threshold := infos[0].Created
+	if infos[1].Created.After(threshold) {
+		threshold = infos[1].Created
+	}
+
+	uploadFile(ctx, t, rfs, "bucket", "new.txt", "contents")
+	uploadFile(ctx, t, rfs, "bucket", "dir/new.txt", "contents")
+
+	infos, _, err = rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{
+		Recursive:     true,
+		ModifiedSince: threshold,
+	})
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, ulloc.NewRemote("bucket", "dir/new.txt"), infos[0].Loc)
+	require.Equal(t, ulloc.NewRemote("bucket", "new.txt"), infos[1].Loc)
+
+	infos, _, err = rfs.ListObjects(ctx, ulloc.NewRemote("bucket", "dir/"), &ListObjectsOptions{
+		ModifiedSince: threshold,
+	})
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, ulloc.NewRemote("bucket", "new.txt"), infos[0].Loc)
+
+	_, _, err = rfs.ListObjects(ctx, ulloc.NewLocal("/home/user"), nil)
+	require.Error(t, err)
+}
+
+func TestSlowCommit(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	type progress struct {
+		committed, total int64
+		stored           bool
+	}
+
+	var reported []progress
+	rfs := newRemoteFilesystem()
+	rfs.commitDelay = 4 * time.Millisecond
+	rfs.commitSteps = 4
+	rfs.commitProgress = func(loc ulloc.Location, committed, total int64) {
+		// only the final report happens after the upload is stored.
+		_, stored := rfs.files[loc]
+		reported = append(reported, progress{committed, total, stored})
+	}
+
+	uploadFile(ctx, t, rfs, "bucket", "file.txt", "12345678")
+
+	require.Equal(t, []progress{
+		{0, 8, false},
+		{2, 8, false},
+		{4, 8, false},
+		{6, 8, false},
+		{8, 8, true},
+	}, reported)
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	sse := ServerSideEncryption{Algorithm: "AES256", Key: "secret"}
+	sseCtx := ContextWithServerSideEncryption(ctx, sse)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(sseCtx, t, rfs, "bucket", "encrypted.txt", "encrypted")
+	uploadFile(ctx, t, rfs, "bucket", "plain.txt", "plain")
+
+	info, err := rfs.Stat(ctx, "bucket", "encrypted.txt")
+	require.NoError(t, err)
+	require.Equal(t, "AES256", info.EncryptionAlgorithm)
+	require.Empty(t, info.Metadata)
+
+	info, err = rfs.Stat(ctx, "bucket", "plain.txt")
+	require.NoError(t, err)
+	require.Empty(t, info.EncryptionAlgorithm)
+
+	infos, _, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), nil)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, "AES256", infos[0].EncryptionAlgorithm)
+	require.Empty(t, infos[1].EncryptionAlgorithm)
+
+	_, err = readFile(ctx, rfs, "bucket", "encrypted.txt")
+	require.Error(t, err)
+
+	_, err = readFile(ContextWithServerSideEncryption(ctx, ServerSideEncryption{Algorithm: "AES256", Key: "wrong"}), rfs, "bucket", "encrypted.txt")
+	require.Error(t, err)
+
+	contents, err := readFile(sseCtx, rfs, "bucket", "encrypted.txt")
+	require.NoError(t, err)
+	require.Equal(t, "encrypted", contents)
+
+	contents, err = readFile(ctx, rfs, "bucket", "plain.txt")
+	require.NoError(t, err)
+	require.Equal(t, "plain", contents)
+}
+
+func TestListObjectsPagination(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	for _, key := range []string{"a", "b", "c", "dir/d", "dir/e", "f", "g"} {
+		uploadFile(ctx, t, rfs, "bucket", key, key)
+	}
+
+	var pages [][]string
+	var token string
+	for {
+		infos, next, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{
+			MaxKeys:           2,
+			ContinuationToken: token,
+		})
+		require.NoError(t, err)
+
+		var page []string
+		for _, info := range infos {
+			page = append(page, info.Loc.Loc())
+		}
+		pages = append(pages, page)
+
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	require.Equal(t, [][]string{
+		{"a", "b"},
+		{"c", "dir/"},
+		{"f", "g"},
+	}, pages)
+
+	infos, token, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{
+		Recursive: true,
+		MaxKeys:   10,
+	})
+	require.NoError(t, err)
+	require.Len(t, infos, 7)
+	require.Empty(t, token)
+}
+
+func TestWriteHandleContextCanceled(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.ensureBucket("bucket")
+
+	for _, commit := range []bool{true, false} {
+		uploadCtx, cancel := context.WithCancel(ctx)
+
+		mwh, err := rfs.Create(uploadCtx, "bucket", "file.txt", nil)
+		require.NoError(t, err)
+
+		wh, err := mwh.NextPart(ctx, -1)
+		require.NoError(t, err)
+
+		_, err = wh.Write([]byte("contents"))
+		require.NoError(t, err)
+		require.NoError(t, wh.Commit())
+
+		cancel()
+
+		if commit {
+			require.ErrorIs(t, mwh.Commit(ctx), context.Canceled)
+			require.Empty(t, rfs.Files())
+			require.Len(t, rfs.Pending(), 1)
+
+			require.NoError(t, rfs.Remove(ctx, "bucket", "file.txt", &ulfs.RemoveOptions{Pending: true}))
+		} else {
+			require.ErrorIs(t, mwh.Abort(ctx), context.Canceled)
+			require.Empty(t, rfs.Files())
+			require.Empty(t, rfs.Pending())
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	build := func() *RemoteFilesystem {
+		rfs := newRemoteFilesystem()
+		rfs.ensureBucket("empty")
+		uploadFile(ctx, t, rfs, "bucket", "b.txt", "b")
+		uploadFile(ctx, t, rfs, "bucket", "a.txt", "a")
+		return rfs
+	}
+
+	rfs := build()
+	fingerprint := rfs.Fingerprint()
+	require.Len(t, fingerprint, 64)
+	require.Equal(t, fingerprint, rfs.Fingerprint())
+	require.Equal(t, fingerprint, build().Fingerprint())
+
+	uploadFile(ctx, t, rfs, "bucket", "a.txt", "changed")
+	changed := rfs.Fingerprint()
+	require.NotEqual(t, fingerprint, changed)
+
+	uploadFile(ctx, t, rfs, "bucket", "a.txt", "a")
+	require.Equal(t, fingerprint, rfs.Fingerprint())
+
+	rfs.ensureBucket("another")
+	require.NotEqual(t, fingerprint, rfs.Fingerprint())
+}
+
+func TestCorruptDownloads(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "bucket", "file.txt", "contents")
+
+	verifiedRead := func() (string, error) {
+		contents, err := readFile(ctx, rfs, "bucket", "file.txt")
+		if err != nil {
+			return "", err
+		}
+		checksum, err := rfs.Checksum(ulloc.NewRemote("bucket", "file.txt"))
+		if err != nil {
+			return "", err
+		}
+		if sha256.Sum256([]byte(contents)) != checksum {
+			return "", errs.New("checksum mismatch")
+		}
+		return contents, nil
+	}
+
+	contents, err := verifiedRead()
+	require.NoError(t, err)
+	require.Equal(t, "contents", contents)
+
+	rfs.corruptDownloads = true
+
+	_, err = verifiedRead()
+	require.EqualError(t, err, "checksum mismatch")
+
+	require.Equal(t, []File{{Loc: "sj://bucket/file.txt", Contents: "contents"}}, rfs.Files())
+}
+
+func TestListObjectsDeleteMarkers(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	now := time.Now()
+	rfs := newRemoteFilesystem()
+	rfs.now = func() time.Time { return now }
+	rfs.deleteGrace = time.Minute
+
+	uploadFile(ctx, t, rfs, "bucket", "deleted", "contents")
+	uploadFile(ctx, t, rfs, "bucket", "kept", "contents")
+	require.NoError(t, rfs.Remove(ctx, "bucket", "deleted", nil))
+
+	prefix := ulloc.NewRemote("bucket", "")
+
+	infos, _, err := rfs.ListObjects(ctx, prefix, &ListObjectsOptions{Recursive: true})
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, ulloc.NewRemote("bucket", "kept"), infos[0].Loc)
+	require.False(t, infos[0].IsDeleteMarker)
+
+	infos, _, err = rfs.ListObjects(ctx, prefix, &ListObjectsOptions{Recursive: true, IncludeDeleteMarkers: true})
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, ulloc.NewRemote("bucket", "deleted"), infos[0].Loc)
+	require.True(t, infos[0].IsDeleteMarker)
+	require.Equal(t, now, infos[0].Created)
+	require.Equal(t, ulloc.NewRemote("bucket", "kept"), infos[1].Loc)
+	require.False(t, infos[1].IsDeleteMarker)
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "bucket", "file", "contents")
+
+	mwh, err := rfs.Create(ctx, "bucket", "pending", nil)
+	require.NoError(t, err)
+	wh, err := mwh.NextPart(ctx, -1)
+	require.NoError(t, err)
+	_, err = wh.Write([]byte("pending"))
+	require.NoError(t, err)
+	require.NoError(t, wh.Commit())
+
+	rfs.readOnly = true
+	before := rfs.Fingerprint()
+
+	t.Run("writes rejected", func(t *testing.T) {
+		_, err := rfs.Create(ctx, "bucket", "other", nil)
+		require.True(t, ErrReadOnly.Has(err))
+
+		require.True(t, ErrReadOnly.Has(mwh.Commit(ctx)))
+		require.True(t, ErrReadOnly.Has(rfs.Remove(ctx, "bucket", "file", nil)))
+		require.True(t, ErrReadOnly.Has(rfs.Move(ctx, "bucket", "file", "bucket", "moved")))
+		require.True(t, ErrReadOnly.Has(rfs.Copy(ctx, "bucket", "file", "bucket", "copied")))
+
+		_, err = rfs.RemoveBucket(ctx, "bucket", true)
+		require.True(t, ErrReadOnly.Has(err))
+
+		require.Equal(t, before, rfs.Fingerprint())
+	})
+
+	t.Run("reads succeed", func(t *testing.T) {
+		contents, err := readFile(ctx, rfs, "bucket", "file")
+		require.NoError(t, err)
+		require.Equal(t, "contents", contents)
+
+		infos, _, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), nil)
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+	})
+}
+
+func TestListObjectsMaxListLimit(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		uploadFile(ctx, t, rfs, "bucket", key, key)
+	}
+	rfs.maxListLimit = 3
+
+	prefix := ulloc.NewRemote("bucket", "")
+	list := func(maxKeys int) (int, string, error) {
+		infos, token, err := rfs.ListObjects(ctx, prefix, &ListObjectsOptions{Recursive: true, MaxKeys: maxKeys})
+		return len(infos), token, err
+	}
+
+	for _, reject := range []bool{false, true} {
+		rfs.rejectListLimit = reject
+
+		n, token, err := list(2)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+		require.Equal(t, "b", token)
+
+		n, token, err = list(3)
+		require.NoError(t, err)
+		require.Equal(t, 3, n)
+		require.Equal(t, "c", token)
+
+		n, token, err = list(0)
+		require.NoError(t, err)
+		require.Equal(t, 3, n)
+		require.Equal(t, "c", token)
+	}
+
+	rfs.rejectListLimit = false
+	n, token, err := list(4)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, "c", token)
+
+	rfs.rejectListLimit = true
+	_, _, err = list(4)
+	require.Error(t, err)
+}
+
+func TestContentTypeSniffing(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.sniffContentType = true
+
+	uploadFile(ctx, t, rfs, "bucket", "text", "hello world")
+	uploadFile(ctx, t, rfs, "bucket", "binary", "\x00\x01\x02\x03")
+	uploadFile(ctx, t, rfs, "bucket", "png", "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+
+	mwh, err := rfs.Create(ctx, "bucket", "provided", &ulfs.CreateOptions{
+		Metadata: map[string]string{ContentTypeMetadataKey: "application/json"},
+	})
+	require.NoError(t, err)
+	wh, err := mwh.NextPart(ctx, -1)
+	require.NoError(t, err)
+	_, err = wh.Write([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, wh.Commit())
+	require.NoError(t, mwh.Commit(ctx))
+
+	contentTypes := map[string]string{}
+	for _, file := range rfs.Files() {
+		contentTypes[file.Loc] = file.Metadata[ContentTypeMetadataKey]
+	}
+	require.Equal(t, map[string]string{
+		"sj://bucket/binary":   "application/octet-stream",
+		"sj://bucket/png":      "image/png",
+		"sj://bucket/provided": "application/json",
+		"sj://bucket/text":     "text/plain; charset=utf-8",
+	}, contentTypes)
+
+	rfs.sniffContentType = false
+	uploadFile(ctx, t, rfs, "bucket", "unsniffed", "hello world")
+	for _, file := range rfs.Files() {
+		if file.Loc == "sj://bucket/unsniffed" {
+			require.Nil(t, file.Metadata)
+		}
+	}
+}
+
+func TestValidateListPrefix(t *testing.T) {
+	require.NoError(t, ValidateListPrefix(ulloc.NewRemote("bucket", "")))
+	require.NoError(t, ValidateListPrefix(ulloc.NewRemote("bucket", "dir/")))
+	require.NoError(t, ValidateListPrefix(ulloc.NewRemote("bucket", "dir/sub/file")))
+
+	require.Error(t, ValidateListPrefix(ulloc.NewRemote("bucket/other", "dir/")))
+	require.Error(t, ValidateListPrefix(ulloc.NewRemote("bucket*", "")))
+	require.Error(t, ValidateListPrefix(ulloc.NewLocal("/tmp/")))
+	require.Error(t, ValidateListPrefix(ulloc.NewStd()))
+
+	ctx := testcontext.New(t)
+	rfs := newRemoteFilesystem()
+	_, _, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket/other", ""), nil)
+	require.Error(t, err)
+}
+
+func TestCreatedClockSkew(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	base := time.Unix(1000, 0)
+	skews := []time.Duration{0, -time.Minute, -30 * time.Second, -2 * time.Minute, time.Minute}
+
+	rfs := newRemoteFilesystem()
+	rfs.createdClock = func() time.Time {
+		skew := skews[0]
+		skews = skews[1:]
+		return base.Add(skew)
+	}
+
+	uploadFile(ctx, t, rfs, "bucket", "c", "c")
+	uploadFile(ctx, t, rfs, "bucket", "a", "a")
+	uploadFile(ctx, t, rfs, "bucket", "b", "b")
+
+	infos, _, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{Recursive: true})
+	require.NoError(t, err)
+	require.Len(t, infos, 3)
+	for i, expected := range []struct {
+		key     string
+		created time.Time
+	}{
+		{key: "a", created: base.Add(-time.Minute)},
+		{key: "b", created: base.Add(-30 * time.Second)},
+		{key: "c", created: base},
+	} {
+		require.Equal(t, ulloc.NewRemote("bucket", expected.key), infos[i].Loc)
+		require.Equal(t, expected.created, infos[i].Created)
+	}
+
+	// pending uploads of the same key are ordered by the skewed created time.
+	for i := 0; i < 2; i++ {
+		_, err := rfs.Create(ctx, "bucket", "pending", nil)
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		iter := rfs.List(ctx, "bucket", "", &ulfs.ListOptions{Pending: true, Recursive: true})
+		var created []time.Time
+		for iter.Next() {
+			created = append(created, iter.Item().Created)
+		}
+		require.NoError(t, iter.Err())
+		require.Equal(t, []time.Time{base.Add(-2 * time.Minute), base.Add(time.Minute)}, created)
+	}
+}
+
+func TestListUploadsOlderThan(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	now := time.Unix(10000, 0)
+	created := now
+	rfs := newRemoteFilesystem()
+	rfs.now = func() time.Time { return now }
+	rfs.createdClock = func() time.Time { return created }
+	rfs.ensureBucket("bucket")
+
+	for _, upload := range []struct {
+		key string
+		age time.Duration
+	}{
+		{key: "day", age: 24 * time.Hour},
+		{key: "hour", age: time.Hour},
+		{key: "dir/week", age: 7 * 24 * time.Hour},
+		{key: "fresh", age: 0},
+	} {
+		created = now.Add(-upload.age)
+		_, err := rfs.Create(ctx, "bucket", upload.key, nil)
+		require.NoError(t, err)
+	}
+
+	keys := func(olderThan time.Duration) (keys []string) {
+		infos, err := rfs.ListUploads(ctx, ulloc.NewRemote("bucket", ""), &ListUploadsOptions{
+			Recursive: true,
+			OlderThan: olderThan,
+		})
+		require.NoError(t, err)
+		for _, info := range infos {
+			_, key, _ := info.Loc.RemoteParts()
+			keys = append(keys, key)
+		}
+		return keys
+	}
+
+	require.Equal(t, []string{"day", "dir/week", "fresh", "hour"}, keys(0))
+	require.Equal(t, []string{"day", "dir/week", "hour"}, keys(time.Minute))
+	require.Equal(t, []string{"day", "dir/week"}, keys(2*time.Hour))
+	require.Equal(t, []string{"dir/week"}, keys(24*time.Hour))
+	require.Empty(t, keys(30*24*time.Hour))
+}
+
+func TestListUploadsOlderThanDefaultClock(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.ensureBucket("bucket")
+
+	// without a created clock, every upload is a second newer than the previous.
+	for _, key := range []string{"first", "second", "third"} {
+		_, err := rfs.Create(ctx, "bucket", key, nil)
+		require.NoError(t, err)
+	}
+
+	keys := func(olderThan time.Duration) (keys []string) {
+		infos, err := rfs.ListUploads(ctx, ulloc.NewRemote("bucket", ""), &ListUploadsOptions{
+			Recursive: true,
+			OlderThan: olderThan,
+		})
+		require.NoError(t, err)
+		for _, info := range infos {
+			_, key, _ := info.Loc.RemoteParts()
+			keys = append(keys, key)
+		}
+		return keys
+	}
+
+	require.Equal(t, []string{"first", "second", "third"}, keys(0))
+	require.Equal(t, []string{"first"}, keys(time.Second))
+	require.Empty(t, keys(time.Hour))
+}
+
+func TestFilesMap(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	require.Empty(t, rfs.FilesMap())
+
+	uploadFile(ctx, t, rfs, "bucket", "a", "contents a")
+	uploadFile(ctx, t, rfs, "bucket", "dir/b", "contents b")
+	uploadFile(ctx, t, rfs, "other", "a", "other a")
+
+	require.Equal(t, map[string]File{
+		"sj://bucket/a":     {Loc: "sj://bucket/a", Contents: "contents a"},
+		"sj://bucket/dir/b": {Loc: "sj://bucket/dir/b", Contents: "contents b"},
+		"sj://other/a":      {Loc: "sj://other/a", Contents: "other a"},
+	}, rfs.FilesMap())
+	require.Equal(t, "contents b", rfs.FilesMap()["sj://bucket/dir/b"].Contents)
+}
+
+func TestCustomMetadata(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.ensureBucket("bucket")
+
+	metadata := map[string]string{"color": "blue", "shape": "round"}
+
+	mwh, err := rfs.Create(ctx, "bucket", "file", &ulfs.CreateOptions{Metadata: metadata})
+	require.NoError(t, err)
+	wh, err := mwh.NextPart(ctx, -1)
+	require.NoError(t, err)
+	_, err = wh.Write([]byte("contents"))
+	require.NoError(t, err)
+	require.NoError(t, wh.Commit())
+
+	// mutating the caller's map must not affect the upload.
+	metadata["color"] = "red"
+	delete(metadata, "shape")
+
+	require.NoError(t, mwh.Commit(ctx))
+
+	expected := map[string]string{"color": "blue", "shape": "round"}
+
+	info, err := rfs.Stat(ctx, "bucket", "file")
+	require.NoError(t, err)
+	require.Equal(t, expected, map[string]string(info.Metadata))
+
+	infos, _, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{Recursive: true})
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, expected, map[string]string(infos[0].Metadata))
+
+	// mutating returned infos must not affect the stored file.
+	info.Metadata["color"] = "green"
+	infos[0].Metadata["shape"] = "square"
+
+	info, err = rfs.Stat(ctx, "bucket", "file")
+	require.NoError(t, err)
+	require.Equal(t, expected, map[string]string(info.Metadata))
+}
+
+func TestIsBucketEmpty(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+
+	_, err := rfs.IsBucketEmpty("missing")
+	require.Error(t, err)
+
+	rfs.ensureBucket("empty")
+	empty, err := rfs.IsBucketEmpty("empty")
+	require.NoError(t, err)
+	require.True(t, empty)
+
+	uploadFile(ctx, t, rfs, "committed", "file", "contents")
+	empty, err = rfs.IsBucketEmpty("committed")
+	require.NoError(t, err)
+	require.False(t, empty)
+
+	rfs.ensureBucket("pending")
+	_, err = rfs.Create(ctx, "pending", "file", nil)
+	require.NoError(t, err)
+	empty, err = rfs.IsBucketEmpty("pending")
+	require.NoError(t, err)
+	require.False(t, empty)
+}
+
+func TestProjectBytes(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+
+	total, byBucket := rfs.ProjectBytes()
+	require.Zero(t, total)
+	require.Empty(t, byBucket)
+
+	uploadFile(ctx, t, rfs, "photos", "a.jpg", "1234")
+	uploadFile(ctx, t, rfs, "photos", "dir/b.jpg", "123456")
+	uploadFile(ctx, t, rfs, "docs", "readme", "12")
+	uploadFile(ctx, t, rfs, "docs", "removed", "1234567890")
+	require.NoError(t, rfs.Remove(ctx, "docs", "removed", nil))
+	rfs.ensureBucket("empty")
+
+	require.NoError(t, rfs.MakeBucket(ctx, "versioned", &MakeBucketOptions{Versioning: VersioningEnabled}))
+	uploadFile(ctx, t, rfs, "versioned", "file", "123")
+	uploadFile(ctx, t, rfs, "versioned", "file", "12345")
+
+	total, byBucket = rfs.ProjectBytes()
+	require.Equal(t, int64(20), total)
+	require.Equal(t, map[string]int64{
+		"photos":    10,
+		"docs":      2,
+		"empty":     0,
+		"versioned": 8,
+	}, byBucket)
+}
+
+func TestListObjectsSuffix(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	for _, key := range []string{"app.log", "app.txt", "logs/old.log", "logs/old.txt", "other/readme.md"} {
+		uploadFile(ctx, t, rfs, "bucket", key, key)
+	}
+
+	list := func(suffix string, recursive bool) (keys []string) {
+		infos, _, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{
+			Recursive: recursive,
+			Suffix:    suffix,
+		})
+		require.NoError(t, err)
+		for _, info := range infos {
+			keys = append(keys, info.Loc.Loc())
+		}
+		return keys
+	}
+
+	require.Equal(t, []string{"app.log", "logs/old.log"}, list(".log", true))
+	require.Equal(t, []string{"app.log", "logs/"}, list(".log", false))
+	require.Empty(t, list(".json", true))
+	require.Len(t, list("", true), 5)
+}
+
+func TestOrphanedUploads(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	now := time.Unix(10000, 0)
+	created := now
+	rfs := newRemoteFilesystem()
+	rfs.now = func() time.Time { return now }
+	rfs.createdClock = func() time.Time { return created }
+	rfs.ensureBucket("bucket")
+
+	created = now.Add(-2 * time.Hour)
+	_, err := rfs.Create(ctx, "bucket", "stale", nil)
+	require.NoError(t, err)
+	committed, err := rfs.Create(ctx, "bucket", "committed", nil)
+	require.NoError(t, err)
+
+	created = now.Add(-time.Minute)
+	_, err = rfs.Create(ctx, "bucket", "fresh", nil)
+	require.NoError(t, err)
+
+	require.NoError(t, committed.Commit(ctx))
+
+	require.Equal(t, []ulloc.Location{ulloc.NewRemote("bucket", "stale")}, rfs.OrphanedUploads(time.Hour))
+	require.Equal(t, []ulloc.Location{
+		ulloc.NewRemote("bucket", "fresh"),
+		ulloc.NewRemote("bucket", "stale"),
+	}, rfs.OrphanedUploads(0))
+	require.Empty(t, rfs.OrphanedUploads(3*time.Hour))
+}
+
+func TestOrphanedUploadsDefaultClock(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.ensureBucket("bucket")
+
+	// without a created clock, every upload is a second newer than the previous.
+	for _, key := range []string{"stale", "recent", "fresh"} {
+		_, err := rfs.Create(ctx, "bucket", key, nil)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []ulloc.Location{ulloc.NewRemote("bucket", "stale")}, rfs.OrphanedUploads(time.Second))
+	require.Empty(t, rfs.OrphanedUploads(time.Hour))
+}
+
+func TestZeroCreatedTime(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "bucket", "b-legacy", "legacy")
+	uploadFile(ctx, t, rfs, "bucket", "a-normal", "normal")
+	uploadFile(ctx, t, rfs, "bucket", "c-legacy", "legacy")
+
+	cs := &callbackState{rfs: rfs}
+	WithoutCreatedTime("sj://bucket/b-legacy").fn(t, ctx, cs)
+	WithoutCreatedTime("sj://bucket/c-legacy").fn(t, ctx, cs)
+
+	infos, _, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{Recursive: true})
+	require.NoError(t, err)
+	require.Len(t, infos, 3)
+
+	require.Equal(t, ulloc.NewRemote("bucket", "a-normal"), infos[0].Loc)
+	require.False(t, infos[0].Created.IsZero())
+	require.Equal(t, ulloc.NewRemote("bucket", "b-legacy"), infos[1].Loc)
+	require.True(t, infos[1].Created.IsZero())
+	require.Equal(t, ulloc.NewRemote("bucket", "c-legacy"), infos[2].Loc)
+	require.True(t, infos[2].Created.IsZero())
+
+	info, err := rfs.Stat(ctx, "bucket", "b-legacy")
+	require.NoError(t, err)
+	require.True(t, info.Created.IsZero())
+
+	infos, _, err = rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{
+		Recursive:     true,
+		ModifiedSince: time.Unix(1, 0),
+	})
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, ulloc.NewRemote("bucket", "a-normal"), infos[0].Loc)
+}
+
+func TestRemoveMany(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "bucket", "a", "a")
+	uploadFile(ctx, t, rfs, "bucket", "b", "b")
+	uploadFile(ctx, t, rfs, "bucket", "keep", "keep")
+	rfs.denied = []deniedPermission{{prefix: ulloc.NewRemote("bucket", "b"), permissions: PermissionDelete}}
+
+	removed, failures := rfs.RemoveMany(ctx, []ulloc.Location{
+		ulloc.NewRemote("bucket", "a"),
+		ulloc.NewRemote("bucket", "missing"),
+		ulloc.NewRemote("bucket", "b"),
+		ulloc.NewLocal("/local"),
+		ulloc.NewRemote("bucket", "a"),
+	})
+	require.Equal(t, 1, removed)
+	require.Len(t, failures, 4)
+	require.Contains(t, failures[0].Error(), "missing")
+	require.True(t, ErrPermissionDenied.Has(failures[1]))
+	require.Contains(t, failures[2].Error(), "not remote")
+	require.Contains(t, failures[3].Error(), "sj://bucket/a")
+
+	require.Equal(t, []File{
+		{Loc: "sj://bucket/b", Contents: "b"},
+		{Loc: "sj://bucket/keep", Contents: "keep"},
+	}, rfs.Files())
+}
+
+func TestDiscardedContents(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.ensureBucket("bucket")
+	rfs.discardContents = true
+
+	mwh, err := rfs.Create(ctx, "bucket", "large", nil)
+	require.NoError(t, err)
+	wh, err := mwh.NextPart(ctx, -1)
+	require.NoError(t, err)
+
+	const chunks = 256
+	chunk := []byte(strings.Repeat("0123456789abcdef", 64<<10/16))
+	hash := sha256.New()
+	for i := 0; i < chunks; i++ {
+		_, err := wh.Write(chunk)
+		require.NoError(t, err)
+		_, _ = hash.Write(chunk)
+	}
+	require.NoError(t, wh.Commit())
+	require.NoError(t, mwh.Commit(ctx))
+
+	const size = chunks * 64 << 10
+
+	info, err := rfs.Stat(ctx, "bucket", "large")
+	require.NoError(t, err)
+	require.Equal(t, int64(size), info.ContentLength)
+
+	checksum, err := rfs.Checksum(ulloc.NewRemote("bucket", "large"))
+	require.NoError(t, err)
+	require.Equal(t, hash.Sum(nil), checksum[:])
+
+	mrh, err := rfs.Open(ctx, "bucket", "large")
+	require.NoError(t, err)
+	defer func() { _ = mrh.Close() }()
+
+	openInfo, err := mrh.Info(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(size), openInfo.ContentLength)
+
+	_, err = readFile(ctx, rfs, "bucket", "large")
+	require.Error(t, err)
+}
+
+func TestDiscardedContentsOutOfOrder(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.ensureBucket("bucket")
+	rfs.discardContents = true
+
+	mwh, err := rfs.Create(ctx, "bucket", "parts", nil)
+	require.NoError(t, err)
+
+	const contents = "part0part1part2part3"
+	var parts []ulfs.WriteHandle
+	for i := 0; i < 4; i++ {
+		wh, err := mwh.NextPart(ctx, 5)
+		require.NoError(t, err)
+		parts = append(parts, wh)
+	}
+
+	// parts of parallel uploads are written out of order.
+	for _, i := range []int{2, 0, 3, 1} {
+		_, err := parts[i].Write([]byte(contents[i*5 : i*5+5]))
+		require.NoError(t, err)
+		require.NoError(t, parts[i].Commit())
+	}
+	require.NoError(t, mwh.Commit(ctx))
+
+	info, err := rfs.Stat(ctx, "bucket", "parts")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(contents)), info.ContentLength)
+
+	checksum, err := rfs.Checksum(ulloc.NewRemote("bucket", "parts"))
+	require.NoError(t, err)
+	require.Equal(t, sha256.Sum256([]byte(contents)), checksum)
+}
+
+func TestValidateNoCaseCollisions(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "bucket", "dir/file.txt", "a")
+	uploadFile(ctx, t, rfs, "bucket", "dir/other.txt", "b")
+	uploadFile(ctx, t, rfs, "other", "dir/File.txt", "c")
+	require.NoError(t, rfs.ValidateNoCaseCollisions())
+
+	uploadFile(ctx, t, rfs, "bucket", "Dir/File.txt", "d")
+	err := rfs.ValidateNoCaseCollisions()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "sj://bucket/Dir/File.txt, sj://bucket/dir/file.txt")
+	require.NotContains(t, err.Error(), "other")
+}
+
+func TestListError(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		uploadFile(ctx, t, rfs, "bucket", key, key)
+	}
+
+	corrupt := errs.New("corrupt row")
+	cs := &callbackState{rfs: rfs}
+	WithListError("sj://bucket/c", corrupt).fn(t, ctx, cs)
+
+	locs, err := listLocations(ctx, rfs, "bucket", "", &ulfs.ListOptions{Recursive: true})
+	require.ErrorIs(t, err, corrupt)
+	require.Equal(t, []ulloc.Location{
+		ulloc.NewRemote("bucket", "a"),
+		ulloc.NewRemote("bucket", "b"),
+	}, locs)
+
+	_, _, err = rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{Recursive: true})
+	require.ErrorIs(t, err, corrupt)
+
+	// listings that don't reach the location succeed.
+	locs, err = listLocations(ctx, rfs, "bucket", "a", nil)
+	require.NoError(t, err)
+	require.Equal(t, []ulloc.Location{ulloc.NewRemote("bucket", "a")}, locs)
+}
+
+func TestTruncatedCommits(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "bucket", "before", "complete contents")
+
+	WithTruncatedCommits(4).fn(t, ctx, &callbackState{rfs: rfs})
+	uploadFile(ctx, t, rfs, "bucket", "short", "abc")
+	uploadFile(ctx, t, rfs, "bucket", "long", "complete contents")
+
+	for _, tt := range []struct {
+		key       string
+		contents  string
+		truncated bool
+	}{
+		{key: "before", contents: "complete contents", truncated: false},
+		{key: "short", contents: "abc", truncated: false},
+		{key: "long", contents: "comp", truncated: true},
+	} {
+		contents, err := readFile(ctx, rfs, "bucket", tt.key)
+		require.NoError(t, err)
+		require.Equal(t, tt.contents, contents, tt.key)
+
+		info, err := rfs.Stat(ctx, "bucket", tt.key)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(tt.contents)), info.ContentLength, tt.key)
+
+		truncated, err := rfs.Truncated(ulloc.NewRemote("bucket", tt.key))
+		require.NoError(t, err)
+		require.Equal(t, tt.truncated, truncated, tt.key)
+	}
+}
+
+func TestListAllByBucket(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "photos", "z.jpg", "z")
+	uploadFile(ctx, t, rfs, "photos", "a.jpg", "a")
+	uploadFile(ctx, t, rfs, "photos", "dir/b.jpg", "b")
+	uploadFile(ctx, t, rfs, "docs", "readme", "readme")
+	rfs.ensureBucket("empty")
+
+	byBucket, err := rfs.ListAllByBucket(ctx)
+	require.NoError(t, err)
+
+	locs := make(map[string][]ulloc.Location)
+	for bucket, infos := range byBucket {
+		locs[bucket] = []ulloc.Location{}
+		for _, info := range infos {
+			locs[bucket] = append(locs[bucket], info.Loc)
+		}
+	}
+	require.Equal(t, map[string][]ulloc.Location{
+		"photos": {
+			ulloc.NewRemote("photos", "a.jpg"),
+			ulloc.NewRemote("photos", "dir/b.jpg"),
+			ulloc.NewRemote("photos", "z.jpg"),
+		},
+		"docs":  {ulloc.NewRemote("docs", "readme")},
+		"empty": {},
+	}, locs)
+}
+
+func TestPrefixLastModified(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	created := base
+	rfs := newRemoteFilesystem()
+	rfs.createdClock = func() time.Time { return created }
+
+	upload := func(key string, at time.Duration) {
+		created = base.Add(at)
+		uploadFile(ctx, t, rfs, "bucket", key, key)
+	}
+	upload("dir/a", 2*time.Hour)
+	upload("dir/b", 5*time.Hour)
+	upload("dir/sub/c", 9*time.Hour)
+	upload("other/d", 12*time.Hour)
+
+	last, err := rfs.PrefixLastModified(ctx, ulloc.NewRemote("bucket", "dir/"), true)
+	require.NoError(t, err)
+	require.Equal(t, base.Add(9*time.Hour), last.UTC())
+
+	last, err = rfs.PrefixLastModified(ctx, ulloc.NewRemote("bucket", "dir/"), false)
+	require.NoError(t, err)
+	require.Equal(t, base.Add(5*time.Hour), last.UTC())
+
+	last, err = rfs.PrefixLastModified(ctx, ulloc.NewRemote("bucket", ""), true)
+	require.NoError(t, err)
+	require.Equal(t, base.Add(12*time.Hour), last.UTC())
+
+	last, err = rfs.PrefixLastModified(ctx, ulloc.NewRemote("bucket", "missing/"), true)
+	require.NoError(t, err)
+	require.True(t, last.IsZero())
+}
+
+func TestShuffledListObjects(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	var sorted []ulloc.Location
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("file%02d", i)
+		uploadFile(ctx, t, rfs, "bucket", key, key)
+		sorted = append(sorted, ulloc.NewRemote("bucket", key))
+	}
+
+	list := func() (locs []ulloc.Location) {
+		infos, _, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", ""), &ListObjectsOptions{Recursive: true})
+		require.NoError(t, err)
+		for _, info := range infos {
+			locs = append(locs, info.Loc)
+		}
+		return locs
+	}
+
+	require.Equal(t, sorted, list())
+
+	WithShuffledListObjects(1).fn(t, ctx, &callbackState{rfs: rfs})
+	shuffled := list()
+	require.NotEqual(t, sorted, shuffled)
+	require.ElementsMatch(t, sorted, shuffled)
+	require.Equal(t, shuffled, list())
+
+	WithShuffledListObjects(2).fn(t, ctx, &callbackState{rfs: rfs})
+	require.NotEqual(t, shuffled, list())
+}
+
+func TestLostCommits(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "bucket", "stored", "contents")
+
+	WithLostCommits().fn(t, ctx, &callbackState{rfs: rfs})
+	uploadFile(ctx, t, rfs, "bucket", "lost", "contents")
+
+	_, err := readFile(ctx, rfs, "bucket", "lost")
+	require.Error(t, err)
+	_, err = rfs.Stat(ctx, "bucket", "lost")
+	require.Error(t, err)
+	require.Empty(t, rfs.Pending())
+
+	contents, err := readFile(ctx, rfs, "bucket", "stored")
+	require.NoError(t, err)
+	require.Equal(t, "contents", contents)
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "bucket", "kept", "kept")
+	uploadFile(ctx, t, rfs, "bucket", "overwritten", "old")
+	uploadFile(ctx, t, rfs, "bucket", "removed", "removed")
+	uploadFile(ctx, t, rfs, "bucket", "moved", "moved")
+
+	before := rfs.Snapshot()
+
+	uploadFile(ctx, t, rfs, "bucket", "overwritten", "new")
+	uploadFile(ctx, t, rfs, "other", "added", "added")
+	require.NoError(t, rfs.Remove(ctx, "bucket", "removed", nil))
+	require.NoError(t, rfs.Move(ctx, "bucket", "moved", "bucket", "dir/moved"))
+
+	added, removed, changed := before.Diff(rfs.Snapshot())
+	require.Equal(t, []File{
+		{Loc: "sj://bucket/dir/moved", Contents: "moved"},
+		{Loc: "sj://other/added", Contents: "added"},
+	}, added)
+	require.Equal(t, []File{
+		{Loc: "sj://bucket/moved", Contents: "moved"},
+		{Loc: "sj://bucket/removed", Contents: "removed"},
+	}, removed)
+	require.Equal(t, []File{
+		{Loc: "sj://bucket/overwritten", Contents: "new"},
+	}, changed)
+
+	added, removed, changed = before.Diff(before)
+	require.Empty(t, added)
+	require.Empty(t, removed)
+	require.Empty(t, changed)
+}
+
+func TestAssignedKeySuffix(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.ensureBucket("bucket")
+
+	assigned := 0
+	WithAssignedKeySuffix(func() string {
+		assigned++
+		return fmt.Sprintf(".%d", assigned)
+	}).fn(t, ctx, &callbackState{rfs: rfs})
+
+	upload := func(key, contents string) ulloc.Location {
+		mwh, err := rfs.Create(ctx, "bucket", key, nil)
+		require.NoError(t, err)
+
+		reporter, ok := mwh.(CommittedLocationReporter)
+		require.True(t, ok)
+		_, committed := reporter.CommittedLocation()
+		require.False(t, committed)
+
+		wh, err := mwh.NextPart(ctx, -1)
+		require.NoError(t, err)
+		_, err = wh.Write([]byte(contents))
+		require.NoError(t, err)
+		require.NoError(t, wh.Commit())
+		require.NoError(t, mwh.Commit(ctx))
+
+		loc, committed := reporter.CommittedLocation()
+		require.True(t, committed)
+		return loc
+	}
+
+	require.Equal(t, ulloc.NewRemote("bucket", "dir/file.1"), upload("dir/file", "first"))
+	require.Equal(t, ulloc.NewRemote("bucket", "dir/file.2"), upload("dir/file", "second"))
+
+	require.Equal(t, []File{
+		{Loc: "sj://bucket/dir/file.1", Contents: "first"},
+		{Loc: "sj://bucket/dir/file.2", Contents: "second"},
+	}, rfs.Files())
+	require.Empty(t, rfs.Pending())
+}
+
+func TestListObjectsBucketBoundary(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	for _, bucket := range []string{"bucket", "bucket-2", "other"} {
+		for _, key := range []string{"dir/a", "dir/b", "dir/sub/c"} {
+			uploadFile(ctx, t, rfs, bucket, key, bucket+"/"+key)
+		}
+	}
+
+	for _, recursive := range []bool{false, true} {
+		infos, _, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", "dir/"), &ListObjectsOptions{Recursive: recursive})
+		require.NoError(t, err)
+		require.NotEmpty(t, infos)
+		for _, info := range infos {
+			bucket, _, _ := info.Loc.RemoteParts()
+			require.Equal(t, "bucket", bucket, info.Loc)
+		}
+
+		locs, err := listLocations(ctx, rfs, "bucket", "dir/", &ulfs.ListOptions{Recursive: recursive})
+		require.NoError(t, err)
+		require.Len(t, locs, len(infos))
+		for _, loc := range locs {
+			bucket, _, _ := loc.RemoteParts()
+			require.Equal(t, "bucket", bucket, loc)
+		}
+	}
+}
+
+func TestObjectInfoSortKey(t *testing.T) {
+	infos := []ulfs.ObjectInfo{
+		{Loc: ulloc.NewRemote("a-b", "a")},
+		{Loc: ulloc.NewRemote("a", "z")},
+		{Loc: ulloc.NewRemote("a", "dir-x")},
+		{Loc: ulloc.NewRemote("a", "dir/x")},
+		{Loc: ulloc.NewRemote("a", "\xff")},
+		{Loc: ulloc.NewLocal("/home/user/file")},
+	}
+
+	// the location strings sort differently than the backend.
+	require.Less(t, infos[0].Loc.String(), infos[1].Loc.String())
+
+	sort.Sort(objectInfos(infos))
+
+	var locs []ulloc.Location
+	for i, info := range infos {
+		locs = append(locs, info.Loc)
+		if i > 0 {
+			require.Less(t, ObjectInfoSortKey(infos[i-1]), ObjectInfoSortKey(info))
+		}
+	}
+	require.Equal(t, []ulloc.Location{
+		ulloc.NewLocal("/home/user/file"),
+		ulloc.NewRemote("a", "dir-x"),
+		ulloc.NewRemote("a", "dir/x"),
+		ulloc.NewRemote("a", "z"),
+		ulloc.NewRemote("a", "\xff"),
+		ulloc.NewRemote("a-b", "a"),
+	}, locs)
+
+	// comparing must not allocate, as sorting compares many times.
+	require.Zero(t, testing.AllocsPerRun(100, func() {
+		_ = objectInfos(infos).Less(1, 2)
+	}))
+}
+
+func TestSetMetadata(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "bucket", "file", "contents")
+	loc := ulloc.NewRemote("bucket", "file")
+
+	before, err := rfs.Checksum(loc)
+	require.NoError(t, err)
+
+	metadata := map[string]string{"color": "blue"}
+	require.NoError(t, rfs.SetMetadata(ctx, loc, metadata))
+	metadata["color"] = "red"
+
+	require.Equal(t, []File{{
+		Loc:      "sj://bucket/file",
+		Contents: "contents",
+		Metadata: map[string]string{"color": "blue"},
+	}}, rfs.Files())
+
+	after, err := rfs.Checksum(loc)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	err = rfs.SetMetadata(ctx, ulloc.NewRemote("bucket", "missing"), metadata)
+	require.Error(t, err)
+	require.Len(t, rfs.Files(), 1)
+}
+
+func TestListObjectsExcludePrefixObject(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	for _, key := range []string{"dir", "dir/", "dir/a", "dir/sub/b"} {
+		uploadFile(ctx, t, rfs, "bucket", key, key)
+	}
+
+	list := func(key string, opts *ListObjectsOptions) (locs []ulloc.Location) {
+		infos, _, err := rfs.ListObjects(ctx, ulloc.NewRemote("bucket", key), opts)
+		require.NoError(t, err)
+		for _, info := range infos {
+			locs = append(locs, info.Loc)
+		}
+		return locs
+	}
+
+	require.Equal(t, []ulloc.Location{
+		ulloc.NewRemote("bucket", "dir/"),
+		ulloc.NewRemote("bucket", "dir/a"),
+		ulloc.NewRemote("bucket", "dir/sub/b"),
+	}, list("dir/", &ListObjectsOptions{Recursive: true}))
+	require.Equal(t, []ulloc.Location{
+		ulloc.NewRemote("bucket", "dir/a"),
+		ulloc.NewRemote("bucket", "dir/sub/b"),
+	}, list("dir/", &ListObjectsOptions{Recursive: true, ExcludePrefixObject: true}))
+
+	require.Equal(t, []ulloc.Location{
+		ulloc.NewRemote("bucket", "dir"),
+		ulloc.NewRemote("bucket", "dir/"),
+	}, list("dir", &ListObjectsOptions{}))
+	require.Equal(t, []ulloc.Location{
+		ulloc.NewRemote("bucket", "dir/"),
+	}, list("dir", &ListObjectsOptions{ExcludePrefixObject: true}))
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2024 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ultest
+
+import (
+	"context"
+	"sort"
+
+	"github.com/zeebo/errs"
+
+	"storj.io/storj/cmd/uplink/ulfs"
+	"storj.io/storj/cmd/uplink/ulloc"
+)
+
+// memPart describes a part of a multipart upload.
+type memPart struct {
+	number uint32
+	size   int64
+}
+
+// MultipartUpload is a pending upload that is built from separately uploaded
+// parts, which are concatenated in part number order on completion.
+type MultipartUpload struct {
+	wh    *memWriteHandle
+	parts map[uint32][]byte
+}
+
+// BeginMultipart starts a multipart upload to the bucket and key.
+func (rfs *RemoteFilesystem) BeginMultipart(ctx context.Context, bucket, key string, opts *ulfs.CreateOptions) (*MultipartUpload, error) {
+	wh, err := rfs.create(ctx, bucket, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	// parts are kept in memory until they are assembled on completion.
+	wh.discard = false
+	return &MultipartUpload{
+		wh:    wh,
+		parts: make(map[uint32][]byte),
+	}, nil
+}
+
+// UploadPart uploads the data as the part with the provided number, replacing
+// any previous upload of the same part.
+func (u *MultipartUpload) UploadPart(number uint32, data []byte) error {
+	u.wh.rfs.mu.Lock()
+	defer u.wh.rfs.mu.Unlock()
+
+	if u.wh.done {
+		return errs.New("upload part to finished upload")
+	}
+	u.parts[number] = append([]byte(nil), data...)
+	return nil
+}
+
+// Complete concatenates the uploaded parts and commits the upload. It fails
+// without finishing the upload when a part other than the last one is smaller
+// than the minimum part size.
+func (u *MultipartUpload) Complete() error {
+	if err := u.assemble(); err != nil {
+		return err
+	}
+	return u.wh.Commit()
+}
+
+// assemble concatenates the parts into the write handle.
+func (u *MultipartUpload) assemble() error {
+	u.wh.rfs.mu.Lock()
+	defer u.wh.rfs.mu.Unlock()
+
+	if u.wh.done {
+		return errs.New("already done")
+	}
+
+	numbers := make([]uint32, 0, len(u.parts))
+	for number := range u.parts {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	for i, number := range numbers {
+		if size := int64(len(u.parts[number])); i < len(numbers)-1 && size < u.wh.rfs.minPartSize {
+			return errs.New("part %d is %d bytes, smaller than the minimum part size %d", number, size, u.wh.rfs.minPartSize)
+		}
+	}
+
+	u.wh.buf = u.wh.buf[:0]
+	u.wh.parts = u.wh.parts[:0]
+	for _, number := range numbers {
+		u.wh.buf = append(u.wh.buf, u.parts[number]...)
+		u.wh.parts = append(u.wh.parts, memPart{
+			number: number,
+			size:   int64(len(u.parts[number])),
+		})
+	}
+
+	return nil
+}
+
+// Abort aborts the upload.
+func (u *MultipartUpload) Abort() error {
+	return u.wh.Abort()
+}
+
+// SegmentPosition is the position of a segment within an object. It mirrors
+// metabase.SegmentPosition.
+type SegmentPosition struct {
+	Part  uint32
+	Index uint32
+}
+
+// SegmentPositions returns the positions of the segments a backend with the
+// provided maximum segment size would create for the committed file. Files
+// that weren't uploaded with multipart consist of a single part 0, and every
+// part has at least one segment.
+func (rfs *RemoteFilesystem) SegmentPositions(loc ulloc.Location, segmentSize int64) ([]SegmentPosition, error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	if segmentSize <= 0 {
+		return nil, errs.New("invalid segment size %d", segmentSize)
+	}
+
+	mf, ok := rfs.lookup(loc)
+	if !ok {
+		return nil, errs.New("file does not exist %q", loc)
+	}
+
+	parts := mf.parts
+	if parts == nil {
+		parts = []memPart{{number: 0, size: mf.size()}}
+	}
+
+	var positions []SegmentPosition
+	for _, part := range parts {
+		segments := (part.size + segmentSize - 1) / segmentSize
+		if segments == 0 {
+			segments = 1
+		}
+		for index := int64(0); index < segments; index++ {
+			positions = append(positions, SegmentPosition{
+				Part:  part.number,
+				Index: uint32(index),
+			})
+		}
+	}
+	return positions, nil
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2024 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ultest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"storj.io/common/testcontext"
+	"storj.io/storj/cmd/uplink/ulloc"
+)
+
+func TestMultipartSegmentPositions(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.ensureBucket("bucket")
+
+	upload, err := rfs.BeginMultipart(ctx, "bucket", "multipart", nil)
+	require.NoError(t, err)
+	require.Len(t, rfs.Pending(), 1)
+
+	require.NoError(t, upload.UploadPart(3, []byte(strings.Repeat("c", 5))))
+	require.NoError(t, upload.UploadPart(1, []byte(strings.Repeat("a", 10))))
+	require.NoError(t, upload.UploadPart(2, []byte(strings.Repeat("b", 4))))
+	require.NoError(t, upload.Complete())
+
+	require.Empty(t, rfs.Pending())
+	require.Equal(t, []File{{
+		Loc:      "sj://bucket/multipart",
+		Contents: strings.Repeat("a", 10) + strings.Repeat("b", 4) + strings.Repeat("c", 5),
+	}}, rfs.Files())
+
+	positions, err := rfs.SegmentPositions(ulloc.NewRemote("bucket", "multipart"), 4)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentPosition{
+		{Part: 1, Index: 0},
+		{Part: 1, Index: 1},
+		{Part: 1, Index: 2},
+		{Part: 2, Index: 0},
+		{Part: 3, Index: 0},
+		{Part: 3, Index: 1},
+	}, positions)
+
+	uploadFile(ctx, t, rfs, "bucket", "single", "")
+	positions, err = rfs.SegmentPositions(ulloc.NewRemote("bucket", "single"), 4)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentPosition{{Part: 0, Index: 0}}, positions)
+
+	_, err = rfs.SegmentPositions(ulloc.NewRemote("bucket", "missing"), 4)
+	require.Error(t, err)
+}
+
+func TestMultipartMinPartSize(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.ensureBucket("bucket")
+	rfs.minPartSize = 5
+
+	t.Run("valid parts", func(t *testing.T) {
+		upload, err := rfs.BeginMultipart(ctx, "bucket", "valid", nil)
+		require.NoError(t, err)
+
+		require.NoError(t, upload.UploadPart(1, []byte("aaaaa")))
+		require.NoError(t, upload.UploadPart(2, []byte("bbbbbb")))
+		require.NoError(t, upload.UploadPart(3, []byte("c")))
+		require.NoError(t, upload.Complete())
+	})
+
+	t.Run("undersized part", func(t *testing.T) {
+		upload, err := rfs.BeginMultipart(ctx, "bucket", "undersized", nil)
+		require.NoError(t, err)
+
+		require.NoError(t, upload.UploadPart(1, []byte("aaaaa")))
+		require.NoError(t, upload.UploadPart(2, []byte("bbbb")))
+		require.NoError(t, upload.UploadPart(3, []byte("ccccc")))
+
+		err = upload.Complete()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "part 2")
+
+		// the upload is still pending and can be fixed.
+		require.Equal(t, []File{{Loc: "sj://bucket/undersized"}}, rfs.Pending())
+		require.NoError(t, upload.UploadPart(2, []byte("bbbbb")))
+		require.NoError(t, upload.Complete())
+	})
+
+	require.Empty(t, rfs.Pending())
+	require.Len(t, rfs.Files(), 2)
+}
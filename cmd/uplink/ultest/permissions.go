@@ -0,0 +1,45 @@
+// Copyright (C) 2024 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ultest
+
+import (
+	"github.com/zeebo/errs"
+
+	"storj.io/storj/cmd/uplink/ulloc"
+)
+
+// ErrPermissionDenied is returned for operations denied with WithDeniedPermissions.
+var ErrPermissionDenied = errs.Class("permission denied")
+
+// Permission is a set of operations that can be denied on a prefix.
+type Permission int
+
+const (
+	// PermissionRead allows downloading and stating objects.
+	PermissionRead Permission = 1 << iota
+	// PermissionWrite allows uploading objects.
+	PermissionWrite
+	// PermissionList allows listing objects.
+	PermissionList
+	// PermissionDelete allows removing objects and buckets.
+	PermissionDelete
+
+	// PermissionAll contains all the permissions.
+	PermissionAll = PermissionRead | PermissionWrite | PermissionList | PermissionDelete
+)
+
+type deniedPermission struct {
+	prefix      ulloc.Location
+	permissions Permission
+}
+
+// checkPermission returns an error when the permission is denied for the location.
+func (rfs *RemoteFilesystem) checkPermission(permission Permission, loc ulloc.Location) error {
+	for _, denied := range rfs.denied {
+		if denied.permissions&permission != 0 && loc.HasPrefix(denied.prefix) {
+			return ErrPermissionDenied.New("%q", loc)
+		}
+	}
+	return nil
+}
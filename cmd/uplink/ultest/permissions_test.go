@@ -0,0 +1,67 @@
+// Copyright (C) 2024 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ultest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"storj.io/common/testcontext"
+	"storj.io/storj/cmd/uplink/ulfs"
+	"storj.io/storj/cmd/uplink/ulloc"
+)
+
+func TestDeniedPermissions(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "readonly", "file", "contents")
+	uploadFile(ctx, t, rfs, "denied", "file", "contents")
+
+	rfs.denied = []deniedPermission{
+		{prefix: ulloc.NewRemote("readonly", ""), permissions: PermissionWrite | PermissionDelete},
+		{prefix: ulloc.NewRemote("denied", ""), permissions: PermissionAll},
+	}
+
+	t.Run("writes denied", func(t *testing.T) {
+		contents, err := readFile(ctx, rfs, "readonly", "file")
+		require.NoError(t, err)
+		require.Equal(t, "contents", contents)
+
+		_, err = rfs.Stat(ctx, "readonly", "file")
+		require.NoError(t, err)
+
+		locs, err := listLocations(ctx, rfs, "readonly", "", &ulfs.ListOptions{Recursive: true})
+		require.NoError(t, err)
+		require.Equal(t, []ulloc.Location{ulloc.NewRemote("readonly", "file")}, locs)
+
+		_, err = rfs.Create(ctx, "readonly", "other", nil)
+		require.True(t, ErrPermissionDenied.Has(err))
+		require.True(t, ErrPermissionDenied.Has(rfs.Remove(ctx, "readonly", "file", nil)))
+		require.True(t, ErrPermissionDenied.Has(rfs.Copy(ctx, "denied", "file", "readonly", "copy")))
+	})
+
+	t.Run("bucket denied", func(t *testing.T) {
+		_, err := readFile(ctx, rfs, "denied", "file")
+		require.True(t, ErrPermissionDenied.Has(err))
+
+		_, err = rfs.Stat(ctx, "denied", "file")
+		require.True(t, ErrPermissionDenied.Has(err))
+
+		_, err = listLocations(ctx, rfs, "denied", "", nil)
+		require.True(t, ErrPermissionDenied.Has(err))
+
+		_, _, err = rfs.ListObjects(ctx, ulloc.NewRemote("denied", ""), nil)
+		require.True(t, ErrPermissionDenied.Has(err))
+
+		_, err = rfs.Create(ctx, "denied", "other", nil)
+		require.True(t, ErrPermissionDenied.Has(err))
+
+		_, err = rfs.RemoveBucket(ctx, "denied", true)
+		require.True(t, ErrPermissionDenied.Has(err))
+	})
+
+	require.Len(t, rfs.Files(), 2)
+}
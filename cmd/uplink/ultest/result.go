@@ -4,6 +4,8 @@
 package ultest
 
 import (
+	"fmt"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
@@ -21,6 +23,10 @@ type Result struct {
 	Err     error
 	Files   []File
 	Pending []File
+
+	// Remote is the remote filesystem the command ran against, for
+	// inspecting state that Files and Pending don't capture.
+	Remote *RemoteFilesystem
 }
 
 // RequireSuccess fails if the Result did not observe a successful execution.
@@ -70,6 +76,9 @@ func (r Result) RequireStderr(t *testing.T, stderr string) Result {
 // existed at the end of the execution. It assumes any passed in files with no
 // contents contain the filename as the contents instead.
 func (r Result) RequireFiles(t *testing.T, files ...File) Result {
+	if diff := DiffFiles(files, r.Files); !diff.Empty() {
+		require.FailNow(t, "unexpected files:", "%s", diff)
+	}
 	require.Equal(t, canonicalizeFiles(files), r.Files)
 	return r
 }
@@ -97,6 +106,95 @@ func (r Result) RequireRemoteFiles(t *testing.T, files ...File) Result {
 	return r
 }
 
+// FileDiff describes how a set of actual files differs from the expected ones.
+type FileDiff struct {
+	Missing []File
+	Extra   []File
+}
+
+// DiffFiles returns the expected files that are missing from actual and the
+// actual files that were not expected. It assumes any expected files with no
+// contents contain the filename as the contents instead.
+func DiffFiles(expected, actual []File) FileDiff {
+	var diff FileDiff
+
+	matched := make([]bool, len(actual))
+next:
+	for _, file := range canonicalizeFiles(expected) {
+		for i := range actual {
+			if !matched[i] && reflect.DeepEqual(file, actual[i]) {
+				matched[i] = true
+				continue next
+			}
+		}
+		diff.Missing = append(diff.Missing, file)
+	}
+
+	for i, file := range actual {
+		if !matched[i] {
+			diff.Extra = append(diff.Extra, file)
+		}
+	}
+	sort.Slice(diff.Extra, func(i, j int) bool { return diff.Extra[i].less(diff.Extra[j]) })
+
+	return diff
+}
+
+// Empty returns true if there is no difference.
+func (diff FileDiff) Empty() bool {
+	return len(diff.Missing) == 0 && len(diff.Extra) == 0
+}
+
+// String returns a line per differing file, prefixed by "-" when missing and
+// "+" when extra.
+func (diff FileDiff) String() string {
+	var b strings.Builder
+	for _, file := range diff.Missing {
+		fmt.Fprintf(&b, "- %s\n", file)
+	}
+	for _, file := range diff.Extra {
+		fmt.Fprintf(&b, "+ %s\n", file)
+	}
+	return b.String()
+}
+
+// Snapshot is the set of files at some point of a test, see
+// RemoteFilesystem.Snapshot. The files of a Result can also be used.
+type Snapshot []File
+
+// Diff returns the files of other that are not in the snapshot, the files of
+// the snapshot that are not in other, and the files of other whose contents or
+// metadata differ from the snapshot. The files are sorted by location.
+func (s Snapshot) Diff(other Snapshot) (added, removed, changed []File) {
+	before := make(map[string]File, len(s))
+	for _, file := range s {
+		before[file.Loc] = file
+	}
+
+	after := make(map[string]bool, len(other))
+	for _, file := range other {
+		after[file.Loc] = true
+
+		prev, ok := before[file.Loc]
+		switch {
+		case !ok:
+			added = append(added, file)
+		case !reflect.DeepEqual(prev, file):
+			changed = append(changed, file)
+		}
+	}
+	for _, file := range s {
+		if !after[file.Loc] {
+			removed = append(removed, file)
+		}
+	}
+
+	for _, files := range [][]File{added, removed, changed} {
+		sort.Slice(files, func(i, j int) bool { return files[i].less(files[j]) })
+	}
+	return added, removed, changed
+}
+
 func filterFiles(files []File, match func(File) bool) (out []File) {
 	for _, file := range files {
 		if match(file) {
@@ -217,6 +315,14 @@ type File struct {
 	Metadata map[string]string
 }
 
+// String returns a readable representation of the file.
+func (f File) String() string {
+	if len(f.Metadata) == 0 {
+		return fmt.Sprintf("%s %q", f.Loc, f.Contents)
+	}
+	return fmt.Sprintf("%s %q %v", f.Loc, f.Contents, f.Metadata)
+}
+
 func (f File) less(g File) bool {
 	fl, _ := ulloc.Parse(f.Loc)
 	gl, _ := ulloc.Parse(g.Loc)
@@ -0,0 +1,36 @@
+// Copyright (C) 2024 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ultest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"storj.io/common/testcontext"
+)
+
+func TestDiffFiles(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	uploadFile(ctx, t, rfs, "bucket", "file1.txt", "sj://bucket/file1.txt")
+	uploadFile(ctx, t, rfs, "bucket", "extra.txt", "extra")
+
+	diff := DiffFiles([]File{
+		{Loc: "sj://bucket/file1.txt"},
+		{Loc: "sj://bucket/missing.txt", Contents: "missing"},
+	}, rfs.Files())
+
+	require.False(t, diff.Empty())
+	require.Equal(t, []File{{Loc: "sj://bucket/missing.txt", Contents: "missing"}}, diff.Missing)
+	require.Equal(t, []File{{Loc: "sj://bucket/extra.txt", Contents: "extra"}}, diff.Extra)
+	require.Equal(t, "- sj://bucket/missing.txt \"missing\"\n+ sj://bucket/extra.txt \"extra\"\n", diff.String())
+
+	diff = DiffFiles([]File{
+		{Loc: "sj://bucket/extra.txt", Contents: "extra"},
+		{Loc: "sj://bucket/file1.txt"},
+	}, rfs.Files())
+	require.True(t, diff.Empty())
+}
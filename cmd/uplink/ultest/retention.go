@@ -0,0 +1,128 @@
+// Copyright (C) 2024 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ultest
+
+import (
+	"context"
+	"time"
+
+	"github.com/zeebo/errs"
+
+	"storj.io/common/storj"
+	"storj.io/storj/cmd/uplink/ulloc"
+)
+
+type memBucket struct {
+	defaultRetention DefaultRetention
+	versioning       Versioning
+}
+
+// Retention is the object lock retention of an object.
+type Retention struct {
+	Mode        storj.RetentionMode
+	RetainUntil time.Time
+}
+
+// Active returns whether the retention prevents removing the object at now.
+func (r Retention) Active(now time.Time) bool {
+	return r.Mode != storj.NoRetention && now.Before(r.RetainUntil)
+}
+
+// checkLocked returns an error when replacing or removing the file at the
+// location would destroy it while its retention is active. Files that the
+// versioning of the bucket keeps as noncurrent versions are not destroyed.
+func (rfs *RemoteFilesystem) checkLocked(loc ulloc.Location) error {
+	mf, ok := rfs.lookup(loc)
+	if !ok {
+		return nil
+	}
+	bucket, _, _ := loc.RemoteParts()
+	if rfs.buckets[bucket].versioning.keeps(mf) {
+		return nil
+	}
+	if mf.retention.Active(rfs.now()) {
+		return errs.New("file %q is protected by object lock", loc)
+	}
+	return nil
+}
+
+// checkAllUnlocked returns an error when any version of the file at the
+// location has an active retention.
+func (rfs *RemoteFilesystem) checkAllUnlocked(loc ulloc.Location) error {
+	now := rfs.now()
+	if rfs.files[loc].retention.Active(now) {
+		return errs.New("file %q is protected by object lock", loc)
+	}
+	for _, mf := range rfs.versions[loc] {
+		if mf.retention.Active(now) {
+			return errs.New("version %d of file %q is protected by object lock", mf.version, loc)
+		}
+	}
+	return nil
+}
+
+// DefaultRetention is the retention applied to objects uploaded into a bucket
+// that do not specify their own retention.
+type DefaultRetention struct {
+	Mode   storj.RetentionMode
+	Period time.Duration
+}
+
+// Enabled returns whether the default retention applies to new objects.
+func (r DefaultRetention) Enabled() bool {
+	return r.Mode != storj.NoRetention && r.Period > 0
+}
+
+type retentionKey struct{}
+
+// ContextWithRetention returns a context that overrides the bucket default
+// retention for uploads created with it.
+func ContextWithRetention(ctx context.Context, retention Retention) context.Context {
+	return context.WithValue(ctx, retentionKey{}, retention)
+}
+
+func retentionFromContext(ctx context.Context) (Retention, bool) {
+	retention, ok := ctx.Value(retentionKey{}).(Retention)
+	return retention, ok
+}
+
+// MakeBucketOptions describes options to MakeBucket.
+type MakeBucketOptions struct {
+	DefaultRetention DefaultRetention
+	Versioning       Versioning
+}
+
+// MakeBucket creates a new bucket. Objects uploaded into it get the default
+// retention unless the upload overrides it.
+func (rfs *RemoteFilesystem) MakeBucket(ctx context.Context, name string, opts *MakeBucketOptions) error {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	if err := rfs.checkWritable("make bucket", ulloc.NewRemote(name, "")); err != nil {
+		return err
+	}
+	if _, ok := rfs.buckets[name]; ok {
+		return errs.New("bucket %q already exists", name)
+	}
+
+	var mb memBucket
+	if opts != nil {
+		mb.defaultRetention = opts.DefaultRetention
+		mb.versioning = opts.Versioning
+	}
+	rfs.buckets[name] = mb
+	return nil
+}
+
+// Retention returns the object lock retention of the file.
+func (rfs *RemoteFilesystem) Retention(loc ulloc.Location) (Retention, error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	mf, ok := rfs.lookup(loc)
+	if !ok {
+		return Retention{}, errs.New("file does not exist %q", loc)
+	}
+	return mf.retention, nil
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2024 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ultest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"storj.io/common/storj"
+	"storj.io/common/testcontext"
+	"storj.io/storj/cmd/uplink/ulloc"
+)
+
+func TestBucketDefaultRetention(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rfs := newRemoteFilesystem()
+	rfs.now = func() time.Time { return now }
+
+	require.NoError(t, rfs.MakeBucket(ctx, "locked", &MakeBucketOptions{
+		DefaultRetention: DefaultRetention{Mode: storj.ComplianceMode, Period: time.Hour},
+	}))
+	require.Error(t, rfs.MakeBucket(ctx, "locked", nil))
+
+	t.Run("inherit default", func(t *testing.T) {
+		uploadFile(ctx, t, rfs, "locked", "inherited", "data")
+
+		retention, err := rfs.Retention(ulloc.NewRemote("locked", "inherited"))
+		require.NoError(t, err)
+		require.Equal(t, Retention{Mode: storj.ComplianceMode, RetainUntil: now.Add(time.Hour)}, retention)
+
+		require.Error(t, rfs.Remove(ctx, "locked", "inherited", nil))
+
+		now = now.Add(2 * time.Hour)
+		require.NoError(t, rfs.Remove(ctx, "locked", "inherited", nil))
+	})
+
+	t.Run("override default", func(t *testing.T) {
+		override := Retention{Mode: storj.GovernanceMode, RetainUntil: now.Add(time.Minute)}
+		uploadFile(ContextWithRetention(ctx, override), t, rfs, "locked", "overridden", "data")
+
+		retention, err := rfs.Retention(ulloc.NewRemote("locked", "overridden"))
+		require.NoError(t, err)
+		require.Equal(t, override, retention)
+
+		uploadFile(ContextWithRetention(ctx, Retention{}), t, rfs, "locked", "unlocked", "data")
+		require.NoError(t, rfs.Remove(ctx, "locked", "unlocked", nil))
+	})
+}
+
+func TestObjectLockPreventsReplacement(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	locked := ContextWithRetention(ctx, Retention{Mode: storj.ComplianceMode, RetainUntil: now.Add(time.Hour)})
+
+	setup := func(t *testing.T, versioning Versioning) *RemoteFilesystem {
+		rfs := newRemoteFilesystem()
+		rfs.now = func() time.Time { return now }
+		require.NoError(t, rfs.MakeBucket(ctx, "bucket", &MakeBucketOptions{Versioning: versioning}))
+		uploadFile(locked, t, rfs, "bucket", "locked", "locked")
+		uploadFile(ctx, t, rfs, "bucket", "other", "other")
+		return rfs
+	}
+	requireContents := func(t *testing.T, rfs *RemoteFilesystem, key, expected string) {
+		contents, err := readFile(ctx, rfs, "bucket", key)
+		require.NoError(t, err)
+		require.Equal(t, expected, contents)
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		rfs := setup(t, Unversioned)
+
+		mwh, err := rfs.Create(ctx, "bucket", "locked", nil)
+		require.NoError(t, err)
+		wh, err := mwh.NextPart(ctx, -1)
+		require.NoError(t, err)
+		_, err = wh.Write([]byte("replaced"))
+		require.NoError(t, err)
+		require.NoError(t, wh.Commit())
+		require.Error(t, mwh.Commit(ctx))
+		requireContents(t, rfs, "locked", "locked")
+	})
+
+	t.Run("commit versioned", func(t *testing.T) {
+		rfs := setup(t, VersioningEnabled)
+
+		uploadFile(ctx, t, rfs, "bucket", "locked", "replaced")
+		requireContents(t, rfs, "locked", "replaced")
+		require.Len(t, rfs.Versions(ulloc.NewRemote("bucket", "locked")), 2)
+	})
+
+	t.Run("move source", func(t *testing.T) {
+		rfs := setup(t, Unversioned)
+
+		require.Error(t, rfs.Move(ctx, "bucket", "locked", "bucket", "moved"))
+		requireContents(t, rfs, "locked", "locked")
+	})
+
+	t.Run("move dest", func(t *testing.T) {
+		rfs := setup(t, Unversioned)
+
+		require.Error(t, rfs.Move(ctx, "bucket", "other", "bucket", "locked"))
+		requireContents(t, rfs, "locked", "locked")
+		requireContents(t, rfs, "other", "other")
+	})
+
+	t.Run("copy dest", func(t *testing.T) {
+		rfs := setup(t, Unversioned)
+
+		require.Error(t, rfs.Copy(ctx, "bucket", "other", "bucket", "locked"))
+		requireContents(t, rfs, "locked", "locked")
+	})
+
+	t.Run("force remove bucket", func(t *testing.T) {
+		rfs := setup(t, VersioningEnabled)
+		require.NoError(t, rfs.Remove(ctx, "bucket", "locked", nil))
+
+		deleted, err := rfs.RemoveBucket(ctx, "bucket", true)
+		require.Error(t, err)
+		require.Zero(t, deleted)
+		requireContents(t, rfs, "other", "other")
+
+		now = now.Add(2 * time.Hour)
+		defer func() { now = now.Add(-2 * time.Hour) }()
+
+		_, err = rfs.RemoveBucket(ctx, "bucket", true)
+		require.NoError(t, err)
+	})
+}
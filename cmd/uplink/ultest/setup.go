@@ -7,8 +7,10 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"math/rand"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/zeebo/clingy"
@@ -113,6 +115,7 @@ func (st State) Run(t *testing.T, args ...string) Result {
 		Err:     err,
 		Files:   files,
 		Pending: rfs.Pending(),
+		Remote:  rfs,
 	}
 }
 
@@ -159,7 +162,7 @@ func collectIterator(ctx context.Context, t *testing.T, fs ulfs.FilesystemLocal,
 type callbackState struct {
 	stdin string
 	fs    ulfs.Filesystem
-	rfs   *remoteFilesystem
+	rfs   *RemoteFilesystem
 }
 
 // ExecuteOption allows one to control the environment that a command executes in.
@@ -174,6 +177,14 @@ func WithFilesystem(cb func(t *testing.T, ctx context.Context, fs ulfs.Filesyste
 	}}
 }
 
+// WithRemote calls the callback with the remote filesystem before the command
+// runs, to configure it or to store files with its methods.
+func WithRemote(cb func(t *testing.T, ctx context.Context, rfs *RemoteFilesystem)) ExecuteOption {
+	return ExecuteOption{func(t *testing.T, ctx context.Context, cs *callbackState) {
+		cb(t, ctx, cs.rfs)
+	}}
+}
+
 // WithBucket ensures the bucket exists.
 func WithBucket(name string) ExecuteOption {
 	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
@@ -181,6 +192,224 @@ func WithBucket(name string) ExecuteOption {
 	}}
 }
 
+// WithBucketOptions creates the bucket with the options, like a default
+// retention or versioning, before the command runs.
+func WithBucketOptions(name string, opts *MakeBucketOptions) ExecuteOption {
+	return ExecuteOption{func(t *testing.T, ctx context.Context, cs *callbackState) {
+		require.NoError(t, cs.rfs.MakeBucket(ctx, name, opts))
+	}}
+}
+
+// WithClock makes the remote filesystem use now as the current time, e.g. for
+// expirations, retentions and delete grace periods, and as the created time of
+// uploads, so tests can move time forward without sleeping.
+func WithClock(now func() time.Time) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.now = now
+		cs.rfs.createdClock = now
+	}}
+}
+
+// WithServerSideEncryption makes the following uploads request server-side
+// encryption and the following downloads provide its key, like a key
+// configured for the client. A zero sse stops providing a key.
+func WithServerSideEncryption(sse ServerSideEncryption) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.sse = sse
+	}}
+}
+
+// WithDeleteGracePeriod keeps removed files readable with Open for the provided
+// duration while hiding them from listings, similar to delete markers.
+func WithDeleteGracePeriod(grace time.Duration) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.deleteGrace = grace
+	}}
+}
+
+// WithKeyNormalizer applies the normalizer to the keys of remote locations
+// passed to Create, Open and Remove.
+func WithKeyNormalizer(normalize func(key string) string) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.normalizeKey = normalize
+	}}
+}
+
+// WithOperationObserver registers a callback that is invoked after every
+// operation on the remote filesystem. The callback must not use the filesystem.
+func WithOperationObserver(observer func(Operation)) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.observers = append(cs.rfs.observers, observer)
+	}}
+}
+
+// WithRequestIDs makes every operation on the remote filesystem get a request
+// ID, reported to the operation observers. The IDs are generated from seed, so
+// the same operations get the same IDs across runs.
+func WithRequestIDs(seed int64) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.requestIDs = rand.New(rand.NewSource(seed))
+	}}
+}
+
+// WithRemoveBucketFailure makes a forced bucket removal fail with err after
+// removing the provided number of files.
+func WithRemoveBucketFailure(after int, err error) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.removeBucketErr = err
+		cs.rfs.removeBucketErrAfter = after
+	}}
+}
+
+// WithSlowCommit makes committing an upload take the provided delay, split into
+// steps increments that are each reported to the progress callback. The
+// progress reaches the total only once the upload is stored.
+func WithSlowCommit(delay time.Duration, steps int, progress func(loc ulloc.Location, committed, total int64)) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.commitDelay = delay
+		cs.rfs.commitSteps = steps
+		cs.rfs.commitProgress = progress
+	}}
+}
+
+// WithCorruptDownloads corrupts the contents returned when opening remote files
+// without changing their stored checksums.
+func WithCorruptDownloads() ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.corruptDownloads = true
+	}}
+}
+
+// WithDeniedPermissions makes operations under the bucket and key prefix that
+// require any of the permissions fail with ErrPermissionDenied.
+func WithDeniedPermissions(bucket, prefix string, permissions Permission) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.denied = append(cs.rfs.denied, deniedPermission{
+			prefix:      ulloc.NewRemote(bucket, prefix),
+			permissions: permissions,
+		})
+	}}
+}
+
+// WithReadOnly rejects every operation that would modify the remote
+// filesystem with ErrReadOnly, while reads and listings keep working.
+func WithReadOnly() ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.readOnly = true
+	}}
+}
+
+// WithMaxListLimit caps the number of keys ListObjects returns per request.
+// Requests for more keys are clamped to the limit, or rejected when reject
+// is set.
+func WithMaxListLimit(limit int, reject bool) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.maxListLimit = limit
+		cs.rfs.rejectListLimit = reject
+	}}
+}
+
+// WithContentTypeSniffing makes committed files without a content type in
+// their metadata store the type detected from their contents.
+func WithContentTypeSniffing() ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.sniffContentType = true
+	}}
+}
+
+// WithCreatedClock makes uploads use the time returned by clock as their
+// created time, which allows simulating clock skew by going backwards.
+func WithCreatedClock(clock func() time.Time) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.createdClock = clock
+	}}
+}
+
+// WithMinPartSize makes completing multipart uploads fail when any part
+// except the last one is smaller than size.
+func WithMinPartSize(size int64) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.minPartSize = size
+	}}
+}
+
+// WithoutCreatedTime removes the created time of the remote file at the
+// location, which must already exist, so that it is reported as the zero time
+// like for some legacy objects.
+func WithoutCreatedTime(location string) ExecuteOption {
+	return ExecuteOption{func(t *testing.T, _ context.Context, cs *callbackState) {
+		loc, err := ulloc.Parse(location)
+		require.NoError(t, err)
+
+		cs.rfs.mu.Lock()
+		defer cs.rfs.mu.Unlock()
+
+		mf, ok := cs.rfs.files[loc]
+		require.True(t, ok, "file does not exist %q", loc)
+		mf.created = 0
+		cs.rfs.files[loc] = mf
+	}}
+}
+
+// WithDiscardedContents makes uploads only record the size and the checksum of
+// their contents, so that large objects can be uploaded without keeping them in
+// memory. Such files have empty contents and fail to be read after Open.
+func WithDiscardedContents() ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.discardContents = true
+	}}
+}
+
+// WithListError makes listings that reach the location stop there and
+// report the error, like when encountering a corrupt object.
+func WithListError(location string, err error) ExecuteOption {
+	return ExecuteOption{func(t *testing.T, _ context.Context, cs *callbackState) {
+		loc, parseErr := ulloc.Parse(location)
+		require.NoError(t, parseErr)
+
+		if cs.rfs.listErrors == nil {
+			cs.rfs.listErrors = make(map[ulloc.Location]error)
+		}
+		cs.rfs.listErrors[loc] = err
+	}}
+}
+
+// WithTruncatedCommits makes commits store only the first length bytes of
+// the uploaded contents, simulating a finalize that was interrupted.
+func WithTruncatedCommits(length int64) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.truncateCommits = true
+		cs.rfs.truncatedLength = length
+	}}
+}
+
+// WithShuffledListObjects makes List and ListObjects return the objects of
+// each listing or page in an order shuffled deterministically by seed instead
+// of sorted.
+func WithShuffledListObjects(seed int64) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.shuffleListObjects = true
+		cs.rfs.shuffleSeed = seed
+	}}
+}
+
+// WithLostCommits makes commits succeed without storing the uploaded files,
+// so that reading them afterwards fails.
+func WithLostCommits() ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.loseCommits = true
+	}}
+}
+
+// WithAssignedKeySuffix makes commits store the uploads at their requested
+// key followed by the value returned by suffix, like a server assigning the
+// final key. The final location is reported by CommittedLocationReporter.
+func WithAssignedKeySuffix(suffix func() string) ExecuteOption {
+	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
+		cs.rfs.assignKeySuffix = suffix
+	}}
+}
+
 // WithStdin sets the command to execute with the provided string as standard input.
 func WithStdin(stdin string) ExecuteOption {
 	return ExecuteOption{func(_ *testing.T, _ context.Context, cs *callbackState) {
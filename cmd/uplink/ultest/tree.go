@@ -0,0 +1,92 @@
+// Copyright (C) 2024 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ultest
+
+import (
+	"sort"
+	"strings"
+
+	"storj.io/storj/cmd/uplink/ulloc"
+)
+
+// Tree is a node in a listing tree built from files. Directory names end with
+// the delimiter, so a file and a directory with the same name are distinct.
+type Tree struct {
+	Name     string
+	Children []*Tree
+	// File is set when the node is a file, or for a directory, when there is
+	// a directory marker object whose key ends with the delimiter.
+	File *File
+}
+
+// BuildTree builds a tree out of the files by splitting their locations on
+// the delimiter. Remote files are placed under a "sj://bucket/" directory.
+func BuildTree(files []File) *Tree {
+	root := &Tree{}
+	for _, file := range files {
+		file := file
+
+		loc, err := ulloc.Parse(file.Loc)
+		if err != nil {
+			continue
+		}
+
+		var names []string
+		if bucket, key, ok := loc.RemoteParts(); ok {
+			names = append([]string{"sj://" + bucket + "/"}, strings.SplitAfter(key, "/")...)
+		} else if path, ok := loc.LocalParts(); ok {
+			names = strings.SplitAfter(path, "/")
+		} else {
+			continue
+		}
+		if len(names) > 1 && names[len(names)-1] == "" {
+			// keys ending with the delimiter are directory markers.
+			names = names[:len(names)-1]
+		}
+
+		node := root
+		for _, name := range names[:len(names)-1] {
+			node = node.child(name)
+		}
+		node.child(names[len(names)-1]).File = &file
+	}
+	root.sort()
+	return root
+}
+
+// child returns the child with the name, adding it when missing.
+func (tree *Tree) child(name string) *Tree {
+	for _, child := range tree.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	child := &Tree{Name: name}
+	tree.Children = append(tree.Children, child)
+	return child
+}
+
+func (tree *Tree) sort() {
+	sort.Slice(tree.Children, func(i, j int) bool { return tree.Children[i].Name < tree.Children[j].Name })
+	for _, child := range tree.Children {
+		child.sort()
+	}
+}
+
+// String returns the names in the tree, one per line and indented by two
+// spaces for each level.
+func (tree *Tree) String() string {
+	var b strings.Builder
+	var write func(node *Tree, depth int)
+	write = func(node *Tree, depth int) {
+		for _, child := range node.Children {
+			b.WriteString(strings.Repeat("  ", depth))
+			b.WriteString(child.Name)
+			b.WriteByte('\n')
+			write(child, depth+1)
+		}
+	}
+	write(tree, 0)
+	return b.String()
+}
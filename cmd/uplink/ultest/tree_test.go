@@ -0,0 +1,51 @@
+// Copyright (C) 2024 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ultest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildTree(t *testing.T) {
+	tree := BuildTree([]File{
+		{Loc: "sj://bucket/dir/sub/deep.txt", Contents: "deep"},
+		{Loc: "sj://bucket/top.txt", Contents: "top"},
+		{Loc: "sj://bucket/dir/file.txt", Contents: "file"},
+		{Loc: "sj://bucket/dir", Contents: "not a directory"},
+		{Loc: "sj://bucket/dir/", Contents: "marker"},
+		{Loc: "sj://other/x", Contents: "x"},
+		{Loc: "/home/user/local.txt", Contents: "local"},
+	})
+
+	require.Equal(t, trimNewlineSpaces(`
+		/
+		  home/
+		    user/
+		      local.txt
+		sj://bucket/
+		  dir
+		  dir/
+		    file.txt
+		    sub/
+		      deep.txt
+		  top.txt
+		sj://other/
+		  x
+	`), trimNewlineSpaces(tree.String()))
+	require.Contains(t, tree.String(), "\n    user/\n")
+
+	bucket := tree.Children[1]
+	require.Equal(t, "sj://bucket/", bucket.Name)
+	require.Nil(t, bucket.File)
+
+	dir := bucket.Children[1]
+	require.Equal(t, "dir/", dir.Name)
+	require.Equal(t, &File{Loc: "sj://bucket/dir/", Contents: "marker"}, dir.File)
+	require.Len(t, dir.Children, 2)
+	require.Equal(t, &File{Loc: "sj://bucket/dir/file.txt", Contents: "file"}, dir.Children[0].File)
+
+	require.Equal(t, &File{Loc: "sj://bucket/dir", Contents: "not a directory"}, bucket.Children[0].File)
+}
@@ -0,0 +1,191 @@
+// Copyright (C) 2024 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ultest
+
+import (
+	"context"
+	"sort"
+
+	"github.com/zeebo/errs"
+
+	"storj.io/storj/cmd/uplink/ulfs"
+	"storj.io/storj/cmd/uplink/ulloc"
+)
+
+// Versioning is the versioning state of a bucket.
+type Versioning int
+
+const (
+	// Unversioned buckets overwrite files on commit.
+	Unversioned Versioning = iota
+	// VersioningEnabled buckets keep the overwritten files as noncurrent
+	// versions.
+	VersioningEnabled
+	// VersioningSuspended buckets overwrite files committed while
+	// versioning was suspended, but keep the versions created while it was
+	// enabled.
+	VersioningSuspended
+)
+
+// keeps returns whether committing over the file keeps it as a noncurrent
+// version.
+func (v Versioning) keeps(prev memFileData) bool {
+	switch v {
+	case VersioningEnabled:
+		return true
+	case VersioningSuspended:
+		return !prev.null
+	default:
+		return false
+	}
+}
+
+// SetBucketVersioning changes the versioning state of the bucket. Like in S3,
+// a bucket that had versioning enabled can only be suspended and can't become
+// unversioned again.
+func (rfs *RemoteFilesystem) SetBucketVersioning(name string, versioning Versioning) error {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	mb, ok := rfs.buckets[name]
+	if !ok {
+		return errs.New("bucket %q does not exist", name)
+	}
+	if versioning == Unversioned && mb.versioning != Unversioned {
+		return errs.New("bucket %q versioning can't be disabled", name)
+	}
+	mb.versioning = versioning
+	rfs.buckets[name] = mb
+	return nil
+}
+
+// removeVersioned replaces the current version of the file with a delete
+// marker. The current version is kept as a noncurrent version unless the
+// versioning of the bucket overwrites it.
+func (rfs *RemoteFilesystem) removeVersioned(loc ulloc.Location, versioning Versioning) {
+	mf, ok := rfs.lookup(loc)
+	if !ok {
+		return
+	}
+	if versioning.keeps(mf) {
+		rfs.versions[loc] = append(rfs.versions[loc], mf)
+	}
+
+	rfs.version++
+	rfs.files[loc] = memFileData{
+		version:      rfs.version,
+		deleted:      rfs.now(),
+		null:         versioning != VersioningEnabled,
+		deleteMarker: true,
+	}
+}
+
+// storeFile makes the file the current version at the location. The previous
+// version is kept as a noncurrent version unless the versioning of the bucket
+// overwrites it.
+func (rfs *RemoteFilesystem) storeFile(loc ulloc.Location, mf memFileData) {
+	bucket, _, _ := loc.RemoteParts()
+	versioning := rfs.buckets[bucket].versioning
+	if prev, ok := rfs.files[loc]; ok && versioning.keeps(prev) {
+		rfs.versions[loc] = append(rfs.versions[loc], prev)
+	}
+
+	rfs.version++
+	mf.version = rfs.version
+	mf.null = versioning != VersioningEnabled
+	rfs.files[loc] = mf
+}
+
+// Versions returns the object infos of all the versions of the file at the
+// location, oldest first, including the current one. Delete markers are
+// flagged with IsDeleteMarker.
+func (rfs *RemoteFilesystem) Versions(loc ulloc.Location) []ulfs.ObjectInfo {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	all := append([]memFileData{}, rfs.versions[loc]...)
+	if mf, ok := rfs.files[loc]; ok {
+		all = append(all, mf)
+	}
+
+	var infos []ulfs.ObjectInfo
+	for _, mf := range all {
+		switch {
+		case mf.deleteMarker:
+			infos = append(infos, ulfs.ObjectInfo{Loc: loc, IsDeleteMarker: true, Created: mf.deleted})
+		case !mf.removed() && !mf.expired(rfs.now()):
+			infos = append(infos, mf.objectInfo(loc))
+		}
+	}
+	return infos
+}
+
+// LatestVersion returns the object info of the newest version of the file at
+// the location. It returns false when there is no such version, or when the
+// newest version was removed or has expired.
+func (rfs *RemoteFilesystem) LatestVersion(loc ulloc.Location) (ulfs.ObjectInfo, bool) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	latest, ok := rfs.files[loc]
+	for _, mf := range rfs.versions[loc] {
+		if !ok || mf.version > latest.version {
+			latest, ok = mf, true
+		}
+	}
+	if !ok || latest.removed() || latest.expired(rfs.now()) {
+		return ulfs.ObjectInfo{}, false
+	}
+	return latest.objectInfo(loc), true
+}
+
+// DistinctKeys returns the locations under the prefix that have at least one
+// version, each listed once regardless of the number of versions. Unless
+// recursive is set, the keys are collapsed into their first component after
+// the prefix.
+func (rfs *RemoteFilesystem) DistinctKeys(ctx context.Context, prefix ulloc.Location, recursive bool) ([]ulloc.Location, error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+
+	if err := ValidateListPrefix(prefix); err != nil {
+		return nil, err
+	}
+	if err := rfs.checkPermission(PermissionList, prefix); err != nil {
+		return nil, err
+	}
+
+	prefixDir := prefix.AsDirectoryish()
+	exists := func(mf memFileData) bool { return !mf.removed() && !mf.expired(rfs.now()) }
+
+	var infos []ulfs.ObjectInfo
+	add := func(loc ulloc.Location) {
+		if loc.HasPrefix(prefixDir) || loc == prefix {
+			infos = append(infos, ulfs.ObjectInfo{Loc: loc})
+		}
+	}
+
+	for loc, mf := range rfs.files {
+		if exists(mf) {
+			add(loc)
+			continue
+		}
+		for _, version := range rfs.versions[loc] {
+			if exists(version) {
+				add(loc)
+				break
+			}
+		}
+	}
+
+	sort.Sort(objectInfos(infos))
+	if !recursive {
+		infos = collapseObjectInfos(prefix, infos)
+	}
+
+	locs := make([]ulloc.Location, 0, len(infos))
+	for _, info := range infos {
+		locs = append(locs, info.Loc)
+	}
+	return locs, nil
+}
@@ -0,0 +1,241 @@
+// Copyright (C) 2024 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ultest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"storj.io/common/testcontext"
+	"storj.io/storj/cmd/uplink/ulloc"
+)
+
+func TestLatestVersion(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.ensureBucket("bucket")
+	require.NoError(t, rfs.SetBucketVersioning("bucket", VersioningEnabled))
+	loc := ulloc.NewRemote("bucket", "file")
+
+	_, ok := rfs.LatestVersion(loc)
+	require.False(t, ok)
+
+	uploadFile(ctx, t, rfs, "bucket", "file", "first")
+	uploadFile(ctx, t, rfs, "bucket", "file", "second version")
+	uploadFile(ctx, t, rfs, "bucket", "other", "other")
+	require.Len(t, rfs.versions[loc], 1)
+
+	latest, ok := rfs.LatestVersion(loc)
+	require.True(t, ok)
+	require.Equal(t, loc, latest.Loc)
+	require.Equal(t, int64(len("second version")), latest.ContentLength)
+	require.Equal(t, time.Unix(2, 0), latest.Created)
+
+	uploadFile(ctx, t, rfs, "bucket", "file", "third")
+
+	latest, ok = rfs.LatestVersion(loc)
+	require.True(t, ok)
+	require.Equal(t, int64(len("third")), latest.ContentLength)
+	require.Equal(t, time.Unix(4, 0), latest.Created)
+
+	require.NoError(t, rfs.Remove(ctx, "bucket", "file", nil))
+	_, ok = rfs.LatestVersion(loc)
+	require.False(t, ok)
+}
+
+func TestDistinctKeys(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	rfs := newRemoteFilesystem()
+	rfs.ensureBucket("bucket")
+	require.NoError(t, rfs.SetBucketVersioning("bucket", VersioningEnabled))
+	uploadFile(ctx, t, rfs, "bucket", "a", "1")
+	uploadFile(ctx, t, rfs, "bucket", "a", "2")
+	uploadFile(ctx, t, rfs, "bucket", "a", "3")
+	uploadFile(ctx, t, rfs, "bucket", "dir/b", "1")
+	uploadFile(ctx, t, rfs, "bucket", "dir/b", "2")
+	uploadFile(ctx, t, rfs, "bucket", "dir/c", "1")
+	uploadFile(ctx, t, rfs, "other", "a", "1")
+
+	locs, err := rfs.DistinctKeys(ctx, ulloc.NewRemote("bucket", ""), true)
+	require.NoError(t, err)
+	require.Equal(t, []ulloc.Location{
+		ulloc.NewRemote("bucket", "a"),
+		ulloc.NewRemote("bucket", "dir/b"),
+		ulloc.NewRemote("bucket", "dir/c"),
+	}, locs)
+
+	locs, err = rfs.DistinctKeys(ctx, ulloc.NewRemote("bucket", ""), false)
+	require.NoError(t, err)
+	require.Equal(t, []ulloc.Location{
+		ulloc.NewRemote("bucket", "a"),
+		ulloc.NewRemote("bucket", "dir/"),
+	}, locs)
+
+	// like listings, collapsed keys are relative to the prefix.
+	locs, err = rfs.DistinctKeys(ctx, ulloc.NewRemote("bucket", "dir/"), false)
+	require.NoError(t, err)
+	require.Equal(t, []ulloc.Location{
+		ulloc.NewRemote("bucket", "b"),
+		ulloc.NewRemote("bucket", "c"),
+	}, locs)
+}
+
+func TestBucketVersioning(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	versions := func(rfs *RemoteFilesystem, key string) (contents []string) {
+		for _, mf := range rfs.versions[ulloc.NewRemote("bucket", key)] {
+			contents = append(contents, mf.contents)
+		}
+		return contents
+	}
+	current := func(t *testing.T, rfs *RemoteFilesystem, key string) string {
+		contents, err := readFile(ctx, rfs, "bucket", key)
+		require.NoError(t, err)
+		return contents
+	}
+
+	t.Run("unversioned", func(t *testing.T) {
+		rfs := newRemoteFilesystem()
+		require.NoError(t, rfs.MakeBucket(ctx, "bucket", nil))
+
+		uploadFile(ctx, t, rfs, "bucket", "file", "1")
+		uploadFile(ctx, t, rfs, "bucket", "file", "2")
+		require.Equal(t, "2", current(t, rfs, "file"))
+		require.Empty(t, versions(rfs, "file"))
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		rfs := newRemoteFilesystem()
+		require.NoError(t, rfs.MakeBucket(ctx, "bucket", &MakeBucketOptions{Versioning: VersioningEnabled}))
+
+		uploadFile(ctx, t, rfs, "bucket", "file", "1")
+		uploadFile(ctx, t, rfs, "bucket", "file", "2")
+		uploadFile(ctx, t, rfs, "bucket", "file", "3")
+		require.Equal(t, "3", current(t, rfs, "file"))
+		require.Equal(t, []string{"1", "2"}, versions(rfs, "file"))
+
+		require.Error(t, rfs.SetBucketVersioning("bucket", Unversioned))
+	})
+
+	t.Run("suspended", func(t *testing.T) {
+		rfs := newRemoteFilesystem()
+		require.NoError(t, rfs.MakeBucket(ctx, "bucket", &MakeBucketOptions{Versioning: VersioningEnabled}))
+
+		uploadFile(ctx, t, rfs, "bucket", "file", "1")
+		uploadFile(ctx, t, rfs, "bucket", "file", "2")
+		require.NoError(t, rfs.SetBucketVersioning("bucket", VersioningSuspended))
+
+		// the version created while enabled is kept, but the null versions
+		// created while suspended overwrite each other.
+		uploadFile(ctx, t, rfs, "bucket", "file", "3")
+		uploadFile(ctx, t, rfs, "bucket", "file", "4")
+		require.Equal(t, "4", current(t, rfs, "file"))
+		require.Equal(t, []string{"1", "2"}, versions(rfs, "file"))
+
+		require.NoError(t, rfs.SetBucketVersioning("bucket", VersioningEnabled))
+		uploadFile(ctx, t, rfs, "bucket", "file", "5")
+		require.Equal(t, []string{"1", "2", "4"}, versions(rfs, "file"))
+	})
+}
+
+func TestRemoveVersioned(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	type version struct {
+		size   int64
+		marker bool
+	}
+	versions := func(rfs *RemoteFilesystem, key string) (all []version) {
+		for _, info := range rfs.Versions(ulloc.NewRemote("bucket", key)) {
+			all = append(all, version{size: info.ContentLength, marker: info.IsDeleteMarker})
+		}
+		return all
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		rfs := newRemoteFilesystem()
+		require.NoError(t, rfs.MakeBucket(ctx, "bucket", &MakeBucketOptions{Versioning: VersioningEnabled}))
+
+		uploadFile(ctx, t, rfs, "bucket", "file", "1")
+		uploadFile(ctx, t, rfs, "bucket", "file", "22")
+		require.NoError(t, rfs.Remove(ctx, "bucket", "file", nil))
+
+		require.Equal(t, []version{{size: 1}, {size: 2}, {marker: true}}, versions(rfs, "file"))
+		_, err := readFile(ctx, rfs, "bucket", "file")
+		require.Error(t, err)
+		require.Empty(t, rfs.Files())
+
+		uploadFile(ctx, t, rfs, "bucket", "file", "333")
+		require.Equal(t, []version{{size: 1}, {size: 2}, {marker: true}, {size: 3}}, versions(rfs, "file"))
+		contents, err := readFile(ctx, rfs, "bucket", "file")
+		require.NoError(t, err)
+		require.Equal(t, "333", contents)
+	})
+
+	t.Run("suspended", func(t *testing.T) {
+		rfs := newRemoteFilesystem()
+		require.NoError(t, rfs.MakeBucket(ctx, "bucket", &MakeBucketOptions{Versioning: VersioningEnabled}))
+
+		uploadFile(ctx, t, rfs, "bucket", "file", "1")
+		require.NoError(t, rfs.SetBucketVersioning("bucket", VersioningSuspended))
+		uploadFile(ctx, t, rfs, "bucket", "file", "22")
+
+		// the null version is replaced by the delete marker.
+		require.NoError(t, rfs.Remove(ctx, "bucket", "file", nil))
+		require.Equal(t, []version{{size: 1}, {marker: true}}, versions(rfs, "file"))
+	})
+
+	t.Run("unversioned", func(t *testing.T) {
+		rfs := newRemoteFilesystem()
+		require.NoError(t, rfs.MakeBucket(ctx, "bucket", nil))
+
+		uploadFile(ctx, t, rfs, "bucket", "file", "1")
+		require.NoError(t, rfs.Remove(ctx, "bucket", "file", nil))
+		require.Empty(t, versions(rfs, "file"))
+	})
+}
+
+func TestMoveVersioned(t *testing.T) {
+	ctx := testcontext.New(t)
+
+	sizes := func(rfs *RemoteFilesystem, key string) (all []int64) {
+		for _, info := range rfs.Versions(ulloc.NewRemote("bucket", key)) {
+			if info.IsDeleteMarker {
+				all = append(all, -1)
+				continue
+			}
+			all = append(all, info.ContentLength)
+		}
+		return all
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		rfs := newRemoteFilesystem()
+		require.NoError(t, rfs.MakeBucket(ctx, "bucket", &MakeBucketOptions{Versioning: VersioningEnabled}))
+
+		uploadFile(ctx, t, rfs, "bucket", "source", "1")
+		uploadFile(ctx, t, rfs, "bucket", "source", "22")
+		uploadFile(ctx, t, rfs, "bucket", "dest", "333")
+		require.NoError(t, rfs.Move(ctx, "bucket", "source", "bucket", "dest"))
+
+		require.Equal(t, []int64{1, 2, -1}, sizes(rfs, "source"))
+		require.Equal(t, []int64{3, 2}, sizes(rfs, "dest"))
+	})
+
+	t.Run("unversioned", func(t *testing.T) {
+		rfs := newRemoteFilesystem()
+		require.NoError(t, rfs.MakeBucket(ctx, "bucket", nil))
+
+		uploadFile(ctx, t, rfs, "bucket", "source", "1")
+		require.NoError(t, rfs.Move(ctx, "bucket", "source", "bucket", "dest"))
+
+		require.Empty(t, sizes(rfs, "source"))
+		require.Equal(t, []int64{1}, sizes(rfs, "dest"))
+	})
+}
@@ -4,6 +4,8 @@
 package metabase
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"database/sql/driver"
 	"encoding/base64"
 	"encoding/binary"
@@ -36,9 +38,10 @@ var (
 
 // Common constants for segment keys.
 const (
-	Delimiter        = '/'
-	LastSegmentName  = "l"
-	LastSegmentIndex = uint32(math.MaxUint32)
+	Delimiter         = '/'
+	LastSegmentName   = "l"
+	LastSegmentIndex  = uint32(math.MaxUint32)
+	FirstSegmentIndex = uint32(0)
 )
 
 // ListLimit is the maximum number of items the client can request for listing.
@@ -61,9 +64,41 @@ const CopySegmentLimit = int64(10000)
 // this from happening, we add 1 to batchSizeLimit.
 const batchsizeLimit = ListLimit + 1
 
+// ValidateBatchSize returns an error when a batch of n items is larger than
+// what is fetched from the storage layer at a time.
+func ValidateBatchSize(n int) error {
+	if n > batchsizeLimit.Max() {
+		return ErrInvalidRequest.New("batch size %d exceeds the limit of %d", n, batchsizeLimit.Max())
+	}
+	return nil
+}
+
 // BucketPrefix consists of <project id>/<bucket name>.
 type BucketPrefix string
 
+// Canonical parses and validates the prefix and returns it with the project ID
+// in the canonical lowercase UUID form with dashes. Bucket names are case
+// sensitive and are kept as they are.
+func (prefix BucketPrefix) Canonical() (BucketPrefix, error) {
+	loc, err := ParseBucketPrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	if loc.BucketName == "" {
+		return "", Error.New("invalid prefix %q: bucket name missing", prefix)
+	}
+	return loc.Prefix(), nil
+}
+
+// BelongsTo parses the prefix and returns whether it belongs to the project.
+func (prefix BucketPrefix) BelongsTo(projectID uuid.UUID) (bool, error) {
+	loc, err := ParseBucketPrefix(prefix)
+	if err != nil {
+		return false, err
+	}
+	return loc.ProjectID == projectID, nil
+}
+
 // BucketLocation defines a bucket that belongs to a project.
 type BucketLocation struct {
 	ProjectID  uuid.UUID
@@ -88,6 +123,24 @@ func ParseBucketPrefix(prefix BucketPrefix) (BucketLocation, error) {
 	}, nil
 }
 
+// ProjectPrefix returns the prefix that contains all buckets of a project,
+// which is <project id>/.
+func ProjectPrefix(projectID uuid.UUID) BucketPrefix {
+	return BucketPrefix(projectID.String() + "/")
+}
+
+// ParseProjectPrefix parses a prefix created by ProjectPrefix.
+func ParseProjectPrefix(prefix BucketPrefix) (uuid.UUID, error) {
+	loc, err := ParseBucketPrefix(prefix)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	if loc.BucketName != "" {
+		return uuid.UUID{}, Error.New("invalid project prefix %q", prefix)
+	}
+	return loc.ProjectID, nil
+}
+
 // Verify object location fields.
 func (loc BucketLocation) Verify() error {
 	switch {
@@ -124,6 +177,29 @@ func (loc BucketLocation) CompactPrefix() []byte {
 	return xs
 }
 
+// LastSegmentKey returns the encoded key of the last segment of the object
+// with the specified key in this bucket.
+//
+// It's equivalent to calling Encode on a SegmentLocation with
+// LastSegmentIndex, but avoids building the intermediate values.
+func (loc BucketLocation) LastSegmentKey(key ObjectKey) SegmentKey {
+	return appendSegmentKey(nil, loc.ProjectID, LastSegmentName, loc.BucketName, key)
+}
+
+// Contains returns whether the segment belongs to this bucket.
+func (loc BucketLocation) Contains(seg SegmentLocation) bool {
+	return loc.ProjectID == seg.ProjectID && loc.BucketName == seg.BucketName
+}
+
+// FirstSegmentKey returns the encoded key of the first segment of the object
+// with the specified key in this bucket.
+//
+// The first segment uses the numbered segment form "s0", unlike the last
+// segment, which uses LastSegmentName.
+func (loc BucketLocation) FirstSegmentKey(key ObjectKey) SegmentKey {
+	return appendSegmentKey(nil, loc.ProjectID, "s0", loc.BucketName, key)
+}
+
 // Compare compares this BucketLocation with another.
 func (loc BucketLocation) Compare(other BucketLocation) int {
 	cmp := loc.ProjectID.Compare(other.ProjectID)
@@ -213,6 +289,65 @@ func (o *ObjectKey) DecodeSpanner(value any) error {
 	return Error.New("unable to scan %T into ObjectKey", value)
 }
 
+// Components splits the object key into its Delimiter separated components.
+//
+// Empty components are preserved, hence keys with leading or trailing
+// delimiters have an empty first or last component respectively.
+func (o ObjectKey) Components() []ObjectKey {
+	parts := strings.Split(string(o), string(Delimiter))
+	components := make([]ObjectKey, len(parts))
+	for i, part := range parts {
+		components[i] = ObjectKey(part)
+	}
+	return components
+}
+
+// HasLeadingDelimiter returns whether the object key starts with Delimiter,
+// which implies an empty first component.
+func (o ObjectKey) HasLeadingDelimiter() bool {
+	return len(o) > 0 && o[0] == Delimiter
+}
+
+// HasTrailingDelimiter returns whether the object key ends with Delimiter.
+func (o ObjectKey) HasTrailingDelimiter() bool {
+	return len(o) > 0 && o[len(o)-1] == Delimiter
+}
+
+// IsUnder returns whether the object key starts with prefix and is strictly
+// longer than it, so that a prefix is never listed as its own child.
+func (o ObjectKey) IsUnder(prefix ObjectKey) bool {
+	return len(o) > len(prefix) && strings.HasPrefix(string(o), string(prefix))
+}
+
+// ValidateAgainst returns an error naming the offset of the first byte of the
+// object key for which disallowed returns true.
+func (o ObjectKey) ValidateAgainst(disallowed func(b byte) bool) error {
+	for i := 0; i < len(o); i++ {
+		if disallowed(o[i]) {
+			return ErrInvalidRequest.New("object key contains disallowed byte 0x%02x at offset %d", o[i], i)
+		}
+	}
+	return nil
+}
+
+// CommonPrefix returns the longest byte-wise common prefix of the keys. The
+// prefix isn't required to end with a delimiter.
+func CommonPrefix(keys []ObjectKey) ObjectKey {
+	if len(keys) == 0 {
+		return ""
+	}
+
+	prefix := keys[0]
+	for _, key := range keys[1:] {
+		n := 0
+		for n < len(prefix) && n < len(key) && prefix[n] == key[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return prefix
+}
+
 // ObjectLocation is decoded object key information.
 type ObjectLocation struct {
 	ProjectID  uuid.UUID
@@ -220,6 +355,15 @@ type ObjectLocation struct {
 	ObjectKey  ObjectKey
 }
 
+// String returns the object location for logs, with the same structure as
+// the segment keys but without the segment token and with the object key in
+// hex, because it's usually encrypted:
+//
+//	<project id>/<bucket name>/<hex object key>
+func (obj ObjectLocation) String() string {
+	return fmt.Sprintf("%s/%s/%x", obj.ProjectID, obj.BucketName, string(obj.ObjectKey))
+}
+
 // Bucket returns bucket location this object belongs to.
 func (obj ObjectLocation) Bucket() BucketLocation {
 	return BucketLocation{
@@ -228,8 +372,79 @@ func (obj ObjectLocation) Bucket() BucketLocation {
 	}
 }
 
+// FirstSegment returns the location of the first segment of the object.
+func (obj ObjectLocation) FirstSegment() SegmentLocation {
+	return obj.Segment(SegmentPosition{Index: FirstSegmentIndex})
+}
+
+// LastSegment returns the location of the last segment of the object.
+func (obj ObjectLocation) LastSegment() SegmentLocation {
+	return obj.Segment(SegmentPosition{Index: LastSegmentIndex})
+}
+
+// Segment returns the location of the segment at the position of the object.
+func (obj ObjectLocation) Segment(position SegmentPosition) SegmentLocation {
+	return SegmentLocation{
+		ProjectID:  obj.ProjectID,
+		BucketName: obj.BucketName,
+		ObjectKey:  obj.ObjectKey,
+		Position:   position,
+	}
+}
+
+// SegmentKeyForPosition returns the encoded key of the segment at the position.
+// The last segment token is used only for the last segment index.
+func (obj ObjectLocation) SegmentKeyForPosition(pos SegmentPosition) SegmentKey {
+	return appendSegmentKey(nil, obj.ProjectID, pos.SegmentToken(), obj.BucketName, obj.ObjectKey)
+}
+
+// MaxReverseSegments is the maximum segment count accepted by
+// ReverseSegments, which allocates a location for every segment.
+const MaxReverseSegments = 1 << 20
+
+// ReverseSegments returns the locations of the segments of an object with
+// count segments in deletion order: the last segment first, followed by the
+// numbered segments in descending order. The count must not exceed
+// MaxReverseSegments.
+func (obj ObjectLocation) ReverseSegments(count int64) ([]SegmentLocation, error) {
+	if count < 1 || count > MaxReverseSegments {
+		return nil, ErrInvalidRequest.New("invalid segment count %d", count)
+	}
+
+	segments := make([]SegmentLocation, 0, count)
+	segments = append(segments, obj.LastSegment())
+	for index := count - 2; index >= 0; index-- {
+		segments = append(segments, obj.Segment(SegmentPosition{Index: uint32(index)}))
+	}
+	return segments, nil
+}
+
+// AllSegmentKeys returns the keys of the segments of an object with count
+// segments in the deletion order of ReverseSegments.
+//
+// The segment token precedes the bucket name and the object key in segment
+// keys, so the segments of an object aren't contiguous and can't be scanned
+// as a single key range. Use these exact keys instead.
+func (obj ObjectLocation) AllSegmentKeys(count int64) ([]SegmentKey, error) {
+	segments, err := obj.ReverseSegments(count)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeSegmentKeys(segments), nil
+}
+
 // Verify object location fields.
 func (obj ObjectLocation) Verify() error {
+	return obj.verify(false)
+}
+
+// VerifyStrict verifies object location fields like Verify and additionally
+// rejects object keys that start with Delimiter.
+func (obj ObjectLocation) VerifyStrict() error {
+	return obj.verify(true)
+}
+
+func (obj ObjectLocation) verify(rejectLeadingDelimiter bool) error {
 	switch {
 	case obj.ProjectID.IsZero():
 		return ErrInvalidRequest.New("ProjectID missing")
@@ -237,6 +452,8 @@ func (obj ObjectLocation) Verify() error {
 		return ErrInvalidRequest.New("BucketName missing")
 	case len(obj.ObjectKey) == 0:
 		return ErrInvalidRequest.New("ObjectKey missing")
+	case rejectLeadingDelimiter && obj.ObjectKey.HasLeadingDelimiter():
+		return ErrInvalidRequest.New("ObjectKey starts with delimiter")
 	}
 	return nil
 }
@@ -244,6 +461,111 @@ func (obj ObjectLocation) Verify() error {
 // SegmentKey is an encoded metainfo key. This is used as the key in pointerdb key-value store.
 type SegmentKey []byte
 
+// MaxSegmentKeyLength is the maximum length of an encoded segment key. It fits
+// the project ID, the longest segment token ("s" followed by the largest
+// encoded position), the longest bucket name and an object key of up to 4000
+// bytes, which is the default maximum encrypted object key length.
+const MaxSegmentKeyLength = len("00000000-0000-0000-0000-000000000000/") +
+	len("s18446744073709551615/") +
+	63 + len("/") +
+	4000
+
+// ValidateLength returns an error when the key is longer than MaxSegmentKeyLength.
+func (k SegmentKey) ValidateLength() error {
+	if len(k) > MaxSegmentKeyLength {
+		return ErrInvalidRequest.New("segment key length %d exceeds the maximum of %d", len(k), MaxSegmentKeyLength)
+	}
+	return nil
+}
+
+// CompareSegmentKeys compares segment keys the same way as the database
+// orders bytea values, i.e. byte-wise and unsigned, with shorter keys sorting
+// first when one is a prefix of the other.
+//
+// Note that this means the last segment token "l" sorts before any numbered
+// segment token "sN", and that numbered tokens are compared as strings
+// rather than numbers, e.g. "s10" sorts before "s9".
+func CompareSegmentKeys(a, b SegmentKey) int {
+	return bytes.Compare(a, b)
+}
+
+// IsLastSegment returns whether the key refers to the last segment of an object.
+// It only inspects the segment token and doesn't validate the other parts of
+// the key.
+func (k SegmentKey) IsLastSegment() (bool, error) {
+	start := bytes.IndexByte(k, Delimiter)
+	if start < 0 {
+		return false, Error.New("invalid key %q", k)
+	}
+	token := k[start+1:]
+
+	end := bytes.IndexByte(token, Delimiter)
+	if end < 0 {
+		return false, Error.New("invalid key %q", k)
+	}
+	token = token[:end]
+
+	if string(token) == LastSegmentName {
+		return true, nil
+	}
+	if len(token) < 2 || token[0] != 's' {
+		return false, Error.New("invalid key %q, invalid segment token %q", k, token)
+	}
+	for _, b := range token[1:] {
+		if b < '0' || b > '9' {
+			return false, Error.New("invalid key %q, invalid segment token %q", k, token)
+		}
+	}
+	return false, nil
+}
+
+// WithBucket returns the key re-encoded with the bucket name replaced. The new
+// bucket name must be non-empty, at most 63 characters long and must not
+// contain the delimiter.
+func (k SegmentKey) WithBucket(bucket string) (SegmentKey, error) {
+	switch {
+	case bucket == "":
+		return nil, ErrInvalidRequest.New("BucketName missing")
+	case len(bucket) > 63:
+		return nil, ErrInvalidRequest.New("BucketName too long: %q", bucket)
+	case strings.IndexByte(bucket, Delimiter) >= 0:
+		return nil, ErrInvalidRequest.New("BucketName contains delimiter: %q", bucket)
+	}
+
+	seg, err := ParseSegmentKey(k)
+	if err != nil {
+		return nil, err
+	}
+	seg.BucketName = BucketName(bucket)
+	return seg.Encode(), nil
+}
+
+// Next returns the smallest key that sorts after k.
+func (k SegmentKey) Next() SegmentKey {
+	next := make(SegmentKey, len(k)+1)
+	copy(next, k)
+	return next
+}
+
+// PrefixSuccessor returns the smallest key that sorts after every key with
+// the prefix k, which makes it usable as an exclusive upper bound for a
+// prefix scan. Trailing 0xFF bytes are dropped before incrementing the last
+// byte. It returns nil when no such key exists, i.e. when k is empty or
+// consists only of 0xFF bytes, meaning the range is unbounded.
+func (k SegmentKey) PrefixSuccessor() SegmentKey {
+	end := len(k)
+	for end > 0 && k[end-1] == 0xFF {
+		end--
+	}
+	if end == 0 {
+		return nil
+	}
+
+	successor := append(SegmentKey{}, k[:end]...)
+	successor[end-1]++
+	return successor
+}
+
 // SegmentLocation is decoded segment key information.
 type SegmentLocation struct {
 	ProjectID  uuid.UUID
@@ -260,6 +582,11 @@ func (seg SegmentLocation) Bucket() BucketLocation {
 	}
 }
 
+// BucketPrefix returns the prefix of the bucket this segment belongs to.
+func (seg SegmentLocation) BucketPrefix() BucketPrefix {
+	return BucketPrefix(seg.ProjectID.String() + "/" + seg.BucketName.String())
+}
+
 // Object returns the object location associated with this segment location.
 func (seg SegmentLocation) Object() ObjectLocation {
 	return ObjectLocation{
@@ -269,6 +596,36 @@ func (seg SegmentLocation) Object() ObjectLocation {
 	}
 }
 
+// SameObject returns whether both segments belong to the same object,
+// ignoring their positions.
+func (seg SegmentLocation) SameObject(other SegmentLocation) bool {
+	return seg.ProjectID == other.ProjectID &&
+		seg.BucketName == other.BucketName &&
+		seg.ObjectKey == other.ObjectKey
+}
+
+// IsLast returns whether the location refers to the last segment.
+func (seg SegmentLocation) IsLast() bool {
+	return seg.Position.Index == LastSegmentIndex
+}
+
+// VerifyIndexForCount verifies that the location refers to one of the
+// segments of a committed object with count segments, including the last one,
+// as returned by ObjectLocation.ReverseSegments. Indexes beyond the numbered
+// segments usually mean a dangling segment reference.
+func (seg SegmentLocation) VerifyIndexForCount(count int64) error {
+	if count < 1 || count > int64(LastSegmentIndex) {
+		return ErrInvalidRequest.New("invalid segment count %d", count)
+	}
+	if seg.IsLast() {
+		return nil
+	}
+	if int64(seg.Position.Index) > count-2 {
+		return ErrInvalidRequest.New("segment index %d is out of range for %d segments", seg.Position.Index, count)
+	}
+	return nil
+}
+
 // ParseSegmentKey parses an segment key into segment location.
 func ParseSegmentKey(encoded SegmentKey) (SegmentLocation, error) {
 	elements := strings.SplitN(string(encoded), "/", 4)
@@ -304,20 +661,171 @@ func ParseSegmentKey(encoded SegmentKey) (SegmentLocation, error) {
 	}, nil
 }
 
+// ParseSegmentKeyToStream parses a segment key and combines it with the
+// version and stream ID, which are not part of the key, into an object stream.
+func ParseSegmentKeyToStream(encoded SegmentKey, version Version, streamID uuid.UUID) (ObjectStream, SegmentPosition, error) {
+	location, err := ParseSegmentKey(encoded)
+	if err != nil {
+		return ObjectStream{}, SegmentPosition{}, err
+	}
+
+	return ObjectStream{
+		ProjectID:  location.ProjectID,
+		BucketName: location.BucketName,
+		ObjectKey:  location.ObjectKey,
+		Version:    version,
+		StreamID:   streamID,
+	}, location.Position, nil
+}
+
+// VerifyKeyRoundTrip verifies that segment locations with the object key are
+// recovered exactly by ParseSegmentKey after encoding them, for the first,
+// a multipart and the last segment position.
+func VerifyKeyRoundTrip(key ObjectKey) error {
+	obj := ObjectLocation{
+		ProjectID:  uuid.UUID{1},
+		BucketName: "bucket",
+		ObjectKey:  key,
+	}
+	for _, seg := range []SegmentLocation{
+		obj.FirstSegment(),
+		obj.Segment(SegmentPosition{Part: 1, Index: 2}),
+		obj.LastSegment(),
+	} {
+		encoded := seg.Encode()
+		parsed, err := ParseSegmentKey(encoded)
+		if err != nil {
+			return Error.New("key %q does not round trip through %q: %w", key, encoded, err)
+		}
+		if parsed != seg {
+			return Error.New("key %q does not round trip through %q: got %q at %v", key, encoded, parsed.ObjectKey, parsed.Position)
+		}
+	}
+	return nil
+}
+
+// String returns the segment location for logs, with the same structure as
+// Encode but with the object key in hex, because it's usually encrypted:
+//
+//	<project id>/<segment token>/<bucket name>/<hex object key>
+func (seg SegmentLocation) String() string {
+	return fmt.Sprintf("%s/%s/%s/%x", seg.ProjectID, seg.Position.SegmentToken(), seg.BucketName, string(seg.ObjectKey))
+}
+
 // Encode converts segment location into a segment key.
 func (seg SegmentLocation) Encode() SegmentKey {
-	segment := LastSegmentName
-	if seg.Position.Index != LastSegmentIndex {
-		segment = "s" + strconv.FormatUint(seg.Position.Encode(), 10)
-	}
 	return SegmentKey(storj.JoinPaths(
 		seg.ProjectID.String(),
-		segment,
+		seg.Position.SegmentToken(),
 		seg.BucketName.String(),
 		string(seg.ObjectKey),
 	))
 }
 
+// EncodeSegmentKeys encodes every segment location into the same key as
+// SegmentLocation.Encode. The keys share a single allocation, which makes it
+// considerably cheaper than encoding a large number of locations separately.
+func EncodeSegmentKeys(locs []SegmentLocation) []SegmentKey {
+	const maxTokenLength = len("s18446744073709551615")
+
+	var projectID uuid.UUID
+	projectIDString := projectID.String()
+
+	size := 0
+	for _, loc := range locs {
+		size += len(projectIDString) + maxTokenLength + len(loc.BucketName) + len(loc.ObjectKey) + 3
+	}
+
+	buf := make([]byte, 0, size)
+	keys := make([]SegmentKey, len(locs))
+
+	for i, loc := range locs {
+		if loc.ProjectID != projectID {
+			projectID, projectIDString = loc.ProjectID, loc.ProjectID.String()
+		}
+
+		start := len(buf)
+		buf = append(buf, projectIDString...)
+		buf = append(buf, '/')
+		buf = loc.Position.appendSegmentToken(buf)
+		buf = append(buf, '/')
+		buf = append(buf, loc.BucketName...)
+		buf = append(buf, '/')
+		buf = append(buf, loc.ObjectKey...)
+		keys[i] = SegmentKey(buf[start:len(buf):len(buf)])
+	}
+	return keys
+}
+
+// SegmentKeyRange is a range of segment keys.
+type SegmentKeyRange struct {
+	Start SegmentKey
+	End   SegmentKey // end is exclusive
+}
+
+// maxKeyspaceShards is the maximum number of shards PartitionKeyspace creates,
+// since it splits the keyspace by the first byte of the object key.
+const maxKeyspaceShards = 256
+
+// PartitionKeyspace divides the last segment keys of the objects in the bucket,
+// which is the keyspace used for listing objects, into contiguous and
+// non-overlapping ranges. The ranges are split on the first byte of the object
+// key, so shards is clamped to [1, 256].
+func PartitionKeyspace(loc BucketLocation, shards int) []SegmentKeyRange {
+	if shards < 1 {
+		shards = 1
+	} else if shards > maxKeyspaceShards {
+		shards = maxKeyspaceShards
+	}
+
+	prefix := appendSegmentKey(nil, loc.ProjectID, LastSegmentName, loc.BucketName, "")
+
+	// the prefix always ends with a delimiter, so the successor always exists.
+	end := SegmentKey(prefix).PrefixSuccessor()
+
+	boundary := func(shard int) SegmentKey {
+		key := make(SegmentKey, len(prefix), len(prefix)+1)
+		copy(key, prefix)
+		return append(key, byte(shard*maxKeyspaceShards/shards))
+	}
+
+	ranges := make([]SegmentKeyRange, shards)
+	for shard := range ranges {
+		if shard == 0 {
+			ranges[shard].Start = append(SegmentKey{}, prefix...)
+		} else {
+			ranges[shard].Start = boundary(shard)
+		}
+		if shard == shards-1 {
+			ranges[shard].End = end
+		} else {
+			ranges[shard].End = boundary(shard + 1)
+		}
+	}
+	return ranges
+}
+
+// appendSegmentKey appends the encoded segment key to xs, growing it at most once.
+func appendSegmentKey(xs []byte, projectID uuid.UUID, segment string, bucket BucketName, key ObjectKey) []byte {
+	projectIDString := projectID.String()
+
+	size := len(projectIDString) + len(segment) + len(bucket) + len(key) + 3
+	if cap(xs)-len(xs) < size {
+		grown := make([]byte, len(xs), len(xs)+size)
+		copy(grown, xs)
+		xs = grown
+	}
+
+	xs = append(xs, projectIDString...)
+	xs = append(xs, '/')
+	xs = append(xs, segment...)
+	xs = append(xs, '/')
+	xs = append(xs, bucket...)
+	xs = append(xs, '/')
+	xs = append(xs, key...)
+	return xs
+}
+
 // Verify segment location fields.
 func (seg SegmentLocation) Verify() error {
 	switch {
@@ -402,6 +910,45 @@ func (obj *ObjectStream) Location() ObjectLocation {
 	}
 }
 
+// Bucket returns the bucket location this object stream belongs to.
+func (obj ObjectStream) Bucket() BucketLocation {
+	return BucketLocation{
+		ProjectID:  obj.ProjectID,
+		BucketName: obj.BucketName,
+	}
+}
+
+// String returns the object stream for logs, which is the form of
+// ObjectLocation.String followed by the version and the stream ID:
+//
+//	<project id>/<bucket name>/<hex object key>@v<version>/<stream id>
+func (obj ObjectStream) String() string {
+	return fmt.Sprintf("%s@v%d/%s", obj.Location(), obj.Version, obj.StreamID)
+}
+
+// SameObject returns whether both object streams belong to the same object,
+// ignoring their versions and stream IDs.
+func (obj ObjectStream) SameObject(other ObjectStream) bool {
+	return obj.ProjectID == other.ProjectID &&
+		obj.BucketName == other.BucketName &&
+		obj.ObjectKey == other.ObjectKey
+}
+
+// WithVersion returns a copy of the object stream with the version replaced.
+func (obj ObjectStream) WithVersion(version Version) ObjectStream {
+	obj.Version = version
+	return obj
+}
+
+// Redacted returns a form of the object stream suitable for logs, which
+// replaces the object key with a truncated hash of it:
+//
+//	<project id>/<bucket name>/<key hash>@v<version>
+func (obj ObjectStream) Redacted() string {
+	hash := sha256.Sum256([]byte(obj.ObjectKey))
+	return fmt.Sprintf("%s/%s/%x@v%d", obj.ProjectID, obj.BucketName, hash[:8], obj.Version)
+}
+
 // PendingObjectStream uniquely defines an pending object and stream.
 type PendingObjectStream struct {
 	ProjectID  uuid.UUID
@@ -431,6 +978,24 @@ type SegmentPosition struct {
 	Index uint32
 }
 
+// SegmentCountForSize returns the number of segments, including the last one,
+// of an object with the given size uploaded with the given segment size. An
+// empty object still has a single segment. It returns an error when
+// segmentSize isn't positive.
+func SegmentCountForSize(size int64, segmentSize int64) (int64, error) {
+	if segmentSize <= 0 {
+		return 0, ErrInvalidRequest.New("invalid segment size %d", segmentSize)
+	}
+	if size <= 0 {
+		return 1, nil
+	}
+	count := size / segmentSize
+	if size%segmentSize != 0 {
+		count++
+	}
+	return count, nil
+}
+
 // SegmentPositionFromEncoded decodes an uint64 into a SegmentPosition.
 func SegmentPositionFromEncoded(v uint64) SegmentPosition {
 	return SegmentPosition{
@@ -439,9 +1004,36 @@ func SegmentPositionFromEncoded(v uint64) SegmentPosition {
 	}
 }
 
+// ParseEncodedSegmentPosition parses a segment position encoded as a decimal
+// number, as found in text dumps of the database.
+func ParseEncodedSegmentPosition(s string) (SegmentPosition, error) {
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return SegmentPosition{}, Error.New("invalid encoded segment position %q", s)
+	}
+	return SegmentPositionFromEncoded(v), nil
+}
+
 // Encode encodes a segment position into an uint64, that can be stored in a database.
 func (pos SegmentPosition) Encode() uint64 { return uint64(pos.Part)<<32 | uint64(pos.Index) }
 
+// SegmentToken returns the segment token used in segment keys, which is
+// LastSegmentName for the last segment and "s<encoded position>" otherwise.
+func (pos SegmentPosition) SegmentToken() string {
+	if pos.Index == LastSegmentIndex {
+		return LastSegmentName
+	}
+	return "s" + strconv.FormatUint(pos.Encode(), 10)
+}
+
+// appendSegmentToken appends the segment token to xs, see SegmentToken.
+func (pos SegmentPosition) appendSegmentToken(xs []byte) []byte {
+	if pos.Index == LastSegmentIndex {
+		return append(xs, LastSegmentName...)
+	}
+	return strconv.AppendUint(append(xs, 's'), pos.Encode(), 10)
+}
+
 // Less returns whether pos should before b.
 func (pos SegmentPosition) Less(b SegmentPosition) bool { return pos.Encode() < b.Encode() }
 
@@ -692,6 +1284,12 @@ type Piece struct {
 	StorageNode storj.NodeID
 }
 
+// IsWithin returns whether the piece number is a valid index in a redundancy
+// scheme with total pieces.
+func (p Piece) IsWithin(total uint16) bool {
+	return p.Number < total
+}
+
 // Verify verifies pieces.
 func (p Pieces) Verify() error {
 	if len(p) == 0 {
@@ -717,6 +1315,65 @@ func (p Pieces) Verify() error {
 	return nil
 }
 
+// VerifyStrict verifies pieces like Verify and additionally rejects pieces
+// that are stored on the same node.
+func (p Pieces) VerifyStrict() error {
+	if err := p.Verify(); err != nil {
+		return err
+	}
+	if !p.HasDistinctNodes() {
+		return ErrInvalidRequest.New("multiple pieces on the same storage node")
+	}
+	return nil
+}
+
+// VerifyAgainstScheme verifies that the piece numbers are within [0, total)
+// of the redundancy scheme and that there are at least required distinct
+// piece numbers.
+func (p Pieces) VerifyAgainstScheme(total, required int) error {
+	numbers := make(map[uint16]struct{}, len(p))
+	for _, piece := range p {
+		if int(piece.Number) >= total {
+			return ErrInvalidRequest.New("piece number %d is out of range [0, %d)", piece.Number, total)
+		}
+		numbers[piece.Number] = struct{}{}
+	}
+	if len(numbers) < required {
+		return ErrInvalidRequest.New("number of distinct pieces %d is less than required %d", len(numbers), required)
+	}
+	return nil
+}
+
+// VerifySegmentsAgainstScheme verifies the pieces of every segment of an
+// object against the redundancy scheme, see Pieces.VerifyAgainstScheme. It
+// returns the indexes of the segments that don't satisfy the scheme and an
+// error describing them.
+func VerifySegmentsAgainstScheme(segments []Pieces, total, required int) (inconsistent []int, err error) {
+	var problems []string
+	for i, pieces := range segments {
+		if err := pieces.VerifyAgainstScheme(total, required); err != nil {
+			inconsistent = append(inconsistent, i)
+			problems = append(problems, fmt.Sprintf("segment %d: %v", i, err))
+		}
+	}
+	if len(inconsistent) > 0 {
+		return inconsistent, ErrInvalidRequest.New("inconsistent segments: %s", strings.Join(problems, "; "))
+	}
+	return nil, nil
+}
+
+// HasDistinctNodes returns whether every piece is stored on a different node.
+func (p Pieces) HasDistinctNodes() bool {
+	nodes := make(map[storj.NodeID]struct{}, len(p))
+	for _, piece := range p {
+		if _, ok := nodes[piece.StorageNode]; ok {
+			return false
+		}
+		nodes[piece.StorageNode] = struct{}{}
+	}
+	return true
+}
+
 // Equal checks if Pieces structures are equal.
 func (p Pieces) Equal(pieces Pieces) bool {
 	if len(p) != len(pieces) {
@@ -758,6 +1415,10 @@ func (p Pieces) Less(i, j int) bool { return p[i].Number < p[j].Number }
 // Swap swaps the pieces with indexes i and j.
 func (p Pieces) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 
+// IsSorted returns whether the pieces are in ascending order of their numbers,
+// which some code assumes.
+func (p Pieces) IsSorted() bool { return sort.IsSorted(p) }
+
 // Add adds the specified pieces and returns the updated Pieces.
 func (p Pieces) Add(piecesToAdd Pieces) (Pieces, error) {
 	return p.Update(piecesToAdd, nil)
@@ -828,3 +1489,149 @@ func (p Pieces) FindByNum(pieceNum int) (_ Piece, found bool) {
 	}
 	return Piece{}, false
 }
+
+// Merge unions the pieces with other by piece number and returns the sorted result.
+//
+// When both contain a piece with the same number, the piece from other wins.
+func (p Pieces) Merge(other Pieces) Pieces {
+	pieceMap := make(map[uint16]Piece, len(p)+len(other))
+	for _, piece := range p {
+		pieceMap[piece.Number] = piece
+	}
+	for _, piece := range other {
+		pieceMap[piece.Number] = piece
+	}
+
+	merged := make(Pieces, 0, len(pieceMap))
+	for _, piece := range pieceMap {
+		merged = append(merged, piece)
+	}
+	sort.Sort(merged)
+
+	return merged
+}
+
+// IntersectNumbers returns the sorted piece numbers present in both p and other.
+func (p Pieces) IntersectNumbers(other Pieces) []uint16 {
+	numbers := make(map[uint16]struct{}, len(other))
+	for _, piece := range other {
+		numbers[piece.Number] = struct{}{}
+	}
+
+	var shared []uint16
+	for _, piece := range p {
+		if _, ok := numbers[piece.Number]; ok {
+			shared = append(shared, piece.Number)
+			delete(numbers, piece.Number)
+		}
+	}
+	sort.Slice(shared, func(i, j int) bool { return shared[i] < shared[j] })
+
+	return shared
+}
+
+// MissingNumbers returns the sorted piece numbers in [0, total) that are not
+// present in the pieces.
+func (p Pieces) MissingNumbers(total uint16) []uint16 {
+	present := make([]bool, total)
+	for _, piece := range p {
+		if piece.IsWithin(total) {
+			present[piece.Number] = true
+		}
+	}
+
+	var missing []uint16
+	for number, ok := range present {
+		if !ok {
+			missing = append(missing, uint16(number))
+		}
+	}
+	return missing
+}
+
+// shortNodeIDLength is the number of characters of a node ID shown in logs.
+const shortNodeIDLength = 8
+
+// String returns a compact representation of the pieces sorted by number,
+// e.g. "[0:1aBcDeFg, 3:2hIjKlMn]", using shortened node IDs.
+func (p Pieces) String() string {
+	sorted := make(Pieces, len(p))
+	copy(sorted, p)
+	sort.Sort(sorted)
+
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, piece := range sorted {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(strconv.Itoa(int(piece.Number)))
+		b.WriteByte(':')
+		b.WriteString(shortNodeID(piece.StorageNode))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// AuditDiff describes the changes from p to other for audit logs, e.g.
+// "added 2,5; removed 1; moved 3 node 1aBcDeFg->2hIjKlMn". Pieces with the
+// same number but a different node are reported as moved. It returns
+// "unchanged" when both contain the same pieces.
+func (p Pieces) AuditDiff(other Pieces) string {
+	before := make(map[uint16]storj.NodeID, len(p))
+	for _, piece := range p {
+		before[piece.Number] = piece.StorageNode
+	}
+
+	var added, moved []string
+	after := make(map[uint16]struct{}, len(other))
+	sorted := make(Pieces, len(other))
+	copy(sorted, other)
+	sort.Sort(sorted)
+	for _, piece := range sorted {
+		after[piece.Number] = struct{}{}
+		number := strconv.Itoa(int(piece.Number))
+
+		node, ok := before[piece.Number]
+		switch {
+		case !ok:
+			added = append(added, number)
+		case node != piece.StorageNode:
+			moved = append(moved, number+" node "+shortNodeID(node)+"->"+shortNodeID(piece.StorageNode))
+		}
+	}
+
+	var removed []string
+	sorted = make(Pieces, len(p))
+	copy(sorted, p)
+	sort.Sort(sorted)
+	for _, piece := range sorted {
+		if _, ok := after[piece.Number]; !ok {
+			removed = append(removed, strconv.Itoa(int(piece.Number)))
+		}
+	}
+
+	var changes []string
+	if len(added) > 0 {
+		changes = append(changes, "added "+strings.Join(added, ","))
+	}
+	if len(removed) > 0 {
+		changes = append(changes, "removed "+strings.Join(removed, ","))
+	}
+	if len(moved) > 0 {
+		changes = append(changes, "moved "+strings.Join(moved, ", "))
+	}
+	if len(changes) == 0 {
+		return "unchanged"
+	}
+	return strings.Join(changes, "; ")
+}
+
+// shortNodeID returns the node ID shortened to shortNodeIDLength characters.
+func shortNodeID(id storj.NodeID) string {
+	nodeID := id.String()
+	if len(nodeID) > shortNodeIDLength {
+		nodeID = nodeID[:shortNodeIDLength]
+	}
+	return nodeID
+}
@@ -4,8 +4,12 @@
 package metabase_test
 
 import (
+	"encoding/hex"
+	"fmt"
 	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -15,6 +19,7 @@ import (
 	"storj.io/common/testrand"
 	"storj.io/common/uuid"
 	"storj.io/storj/satellite/metabase"
+	"storj.io/storj/satellite/metabase/metabasetest"
 	"storj.io/uplink/private/eestream"
 )
 
@@ -62,6 +67,79 @@ func TestParseBucketPrefixValid(t *testing.T) {
 	}
 }
 
+func TestBucketPrefixBelongsTo(t *testing.T) {
+	projectID := testrand.UUID()
+
+	for _, prefix := range []metabase.BucketPrefix{
+		metabase.BucketPrefix(projectID.String() + "/bucket"),
+		metabase.BucketPrefix(strings.ToUpper(projectID.String()) + "/bucket"),
+	} {
+		belongs, err := prefix.BelongsTo(projectID)
+		require.NoError(t, err)
+		require.True(t, belongs, prefix)
+
+		belongs, err = prefix.BelongsTo(testrand.UUID())
+		require.NoError(t, err)
+		require.False(t, belongs, prefix)
+	}
+
+	for _, malformed := range []metabase.BucketPrefix{"", "not-a-uuid/bucket"} {
+		belongs, err := malformed.BelongsTo(projectID)
+		require.Error(t, err, malformed)
+		require.False(t, belongs, malformed)
+	}
+}
+
+func TestBucketPrefixCanonical(t *testing.T) {
+	projectID := testrand.UUID()
+	canonical := metabase.BucketPrefix(projectID.String() + "/Bucket")
+
+	prefix, err := canonical.Canonical()
+	require.NoError(t, err)
+	require.Equal(t, canonical, prefix)
+
+	for _, nonCanonical := range []string{
+		strings.ToUpper(projectID.String()),
+		strings.ReplaceAll(projectID.String(), "-", ""),
+		strings.ToUpper(strings.ReplaceAll(projectID.String(), "-", "")),
+	} {
+		prefix, err := metabase.BucketPrefix(nonCanonical + "/Bucket").Canonical()
+		require.NoError(t, err)
+		require.Equal(t, canonical, prefix)
+	}
+
+	for _, invalid := range []metabase.BucketPrefix{
+		"",
+		"not-a-uuid/bucket",
+		metabase.BucketPrefix(projectID.String()),
+		metabase.BucketPrefix(projectID.String() + "/"),
+		metabase.BucketPrefix(projectID.String() + "/bucket/key"),
+	} {
+		_, err := invalid.Canonical()
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestProjectPrefix(t *testing.T) {
+	projectID := testrand.UUID()
+
+	prefix := metabase.ProjectPrefix(projectID)
+	require.Equal(t, metabase.BucketPrefix(projectID.String()+"/"), prefix)
+
+	parsed, err := metabase.ParseProjectPrefix(prefix)
+	require.NoError(t, err)
+	require.Equal(t, projectID, parsed)
+
+	_, err = metabase.ParseProjectPrefix(metabase.BucketLocation{ProjectID: projectID, BucketName: "bucket"}.Prefix())
+	require.Error(t, err)
+
+	_, err = metabase.ParseProjectPrefix("not UUID string/")
+	require.Error(t, err)
+
+	_, err = metabase.ParseProjectPrefix(metabase.BucketPrefix(projectID.String()))
+	require.Error(t, err)
+}
+
 func TestParseSegmentKeyInvalid(t *testing.T) {
 	var testCases = []struct {
 		name       string
@@ -209,6 +287,791 @@ func TestParseSegmentKeyValid(t *testing.T) {
 	}
 }
 
+func TestObjectKeyRoundTrips(t *testing.T) {
+	for _, key := range []metabase.ObjectKey{
+		"key",
+		"a/b/c/d",
+		"a//b///c",
+		"/leading",
+		"trailing/",
+		"a/b/c/",
+		"//",
+		"l/s0/bucket/key",
+		"\x00/\xff/",
+	} {
+		metabasetest.AssertKeyRoundTrips(t, key)
+	}
+}
+
+func TestParseSegmentKeyPosition(t *testing.T) {
+	projectID := testrand.UUID()
+
+	// the last segment token maps to the last segment index in part 0.
+	seg, err := metabase.ParseSegmentKey(metabase.SegmentKey(projectID.String() + "/l/bucket/key"))
+	require.NoError(t, err)
+	require.Equal(t, metabase.SegmentPosition{Index: metabase.LastSegmentIndex}, seg.Position)
+	require.True(t, seg.IsLast())
+
+	// numbered tokens hold the encoded part and index.
+	encoded := metabase.SegmentPosition{Part: 3, Index: 7}.Encode()
+	seg, err = metabase.ParseSegmentKey(metabase.SegmentKey(projectID.String() + "/s" + strconv.FormatUint(encoded, 10) + "/bucket/key"))
+	require.NoError(t, err)
+	require.Equal(t, metabase.SegmentPosition{Part: 3, Index: 7}, seg.Position)
+	require.False(t, seg.IsLast())
+
+	seg, err = metabase.ParseSegmentKey(metabase.SegmentKey(projectID.String() + "/s5/bucket/key"))
+	require.NoError(t, err)
+	require.Equal(t, metabase.SegmentPosition{Index: 5}, seg.Position)
+}
+
+func TestSegmentKeyFirstAndLastRoundTrip(t *testing.T) {
+	object := metabase.ObjectLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "testbucket",
+		ObjectKey:  "a/b",
+	}
+
+	first := object.FirstSegment()
+	require.Equal(t, metabase.FirstSegmentIndex, first.Position.Index)
+	require.False(t, first.IsLast())
+
+	firstKey := first.Encode()
+	require.Equal(t, metabase.SegmentKey(object.ProjectID.String()+"/s0/testbucket/a/b"), firstKey)
+
+	parsed, err := metabase.ParseSegmentKey(firstKey)
+	require.NoError(t, err)
+	require.Equal(t, first, parsed)
+	require.False(t, parsed.IsLast())
+
+	last := object.LastSegment()
+	require.Equal(t, metabase.LastSegmentIndex, last.Position.Index)
+	require.True(t, last.IsLast())
+
+	lastKey := last.Encode()
+	require.Equal(t, metabase.SegmentKey(object.ProjectID.String()+"/l/testbucket/a/b"), lastKey)
+
+	parsed, err = metabase.ParseSegmentKey(lastKey)
+	require.NoError(t, err)
+	require.Equal(t, last, parsed)
+	require.True(t, parsed.IsLast())
+
+	// the index right before the last segment sentinel must not be confused with it.
+	beforeLast := object.Segment(metabase.SegmentPosition{Index: metabase.LastSegmentIndex - 1})
+	parsed, err = metabase.ParseSegmentKey(beforeLast.Encode())
+	require.NoError(t, err)
+	require.Equal(t, beforeLast, parsed)
+	require.False(t, parsed.IsLast())
+}
+
+func TestParseSegmentKeyToStream(t *testing.T) {
+	projectID := testrand.UUID()
+	streamID := testrand.UUID()
+
+	stream, position, err := metabase.ParseSegmentKeyToStream(
+		metabase.SegmentKey(projectID.String()+"/s"+strconv.FormatInt(2<<32+5, 10)+"/testbucket/test/object"),
+		metabase.Version(7), streamID)
+	require.NoError(t, err)
+	require.Equal(t, metabase.ObjectStream{
+		ProjectID:  projectID,
+		BucketName: "testbucket",
+		ObjectKey:  "test/object",
+		Version:    7,
+		StreamID:   streamID,
+	}, stream)
+	require.Equal(t, metabase.SegmentPosition{Part: 2, Index: 5}, position)
+
+	stream, position, err = metabase.ParseSegmentKeyToStream(
+		metabase.SegmentKey(projectID.String()+"/l/testbucket/object"),
+		metabase.DefaultVersion, streamID)
+	require.NoError(t, err)
+	require.Equal(t, metabase.ObjectKey("object"), stream.ObjectKey)
+	require.Equal(t, metabase.DefaultVersion, stream.Version)
+	require.Equal(t, metabase.LastSegmentIndex, position.Index)
+
+	_, _, err = metabase.ParseSegmentKeyToStream(
+		metabase.SegmentKey(projectID.String()+"/x0/testbucket/object"),
+		metabase.DefaultVersion, streamID)
+	require.Error(t, err)
+}
+
+func TestParseEncodedSegmentPosition(t *testing.T) {
+	for _, pos := range []metabase.SegmentPosition{
+		{},
+		{Index: 5},
+		{Part: 2, Index: 3},
+		{Part: math.MaxUint32, Index: math.MaxUint32},
+	} {
+		parsed, err := metabase.ParseEncodedSegmentPosition(strconv.FormatUint(pos.Encode(), 10))
+		require.NoError(t, err)
+		require.Equal(t, pos, parsed)
+	}
+
+	parsed, err := metabase.ParseEncodedSegmentPosition("8589934595")
+	require.NoError(t, err)
+	require.Equal(t, metabase.SegmentPosition{Part: 2, Index: 3}, parsed)
+
+	for _, malformed := range []string{"", "abc", "-1", "1.5", " 1", "18446744073709551616"} {
+		_, err := metabase.ParseEncodedSegmentPosition(malformed)
+		require.Error(t, err, malformed)
+	}
+}
+
+func TestSegmentPositionSegmentToken(t *testing.T) {
+	require.Equal(t, metabase.LastSegmentName, metabase.SegmentPosition{Index: metabase.LastSegmentIndex}.SegmentToken())
+	require.Equal(t, metabase.LastSegmentName, metabase.SegmentPosition{Part: 3, Index: metabase.LastSegmentIndex}.SegmentToken())
+
+	require.Equal(t, "s0", metabase.SegmentPosition{}.SegmentToken())
+	require.Equal(t, "s4294967298", metabase.SegmentPosition{Part: 1, Index: 2}.SegmentToken())
+
+	location := metabase.SegmentLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "bucket",
+		ObjectKey:  "key",
+		Position:   metabase.SegmentPosition{Part: 1, Index: 2},
+	}
+	require.Equal(t, metabase.SegmentKey(location.ProjectID.String()+"/s4294967298/bucket/key"), location.Encode())
+}
+
+func TestSegmentKeyWithBucket(t *testing.T) {
+	seg := metabase.SegmentLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "old-bucket",
+		ObjectKey:  "a/b/c",
+		Position:   metabase.SegmentPosition{Part: 1, Index: 3},
+	}
+
+	key, err := seg.Encode().WithBucket("new-bucket")
+	require.NoError(t, err)
+
+	expected := seg
+	expected.BucketName = "new-bucket"
+	require.Equal(t, expected.Encode(), key)
+
+	last, err := seg.Object().LastSegment().Encode().WithBucket("new-bucket")
+	require.NoError(t, err)
+	require.Equal(t, expected.Object().LastSegment().Encode(), last)
+
+	for _, invalid := range []string{"", "a/b", strings.Repeat("b", 64)} {
+		_, err := seg.Encode().WithBucket(invalid)
+		require.True(t, metabase.ErrInvalidRequest.Has(err), invalid)
+	}
+
+	_, err = metabase.SegmentKey("invalid").WithBucket("bucket")
+	require.Error(t, err)
+}
+
+func TestSegmentKeyNext(t *testing.T) {
+	for _, key := range []metabase.SegmentKey{
+		nil,
+		metabase.SegmentKey("a"),
+		metabase.SegmentKey("a/b"),
+		metabase.SegmentKey("a\xff"),
+	} {
+		next := key.Next()
+		require.Equal(t, append(append(metabase.SegmentKey{}, key...), 0), next)
+		require.Equal(t, 1, metabase.CompareSegmentKeys(next, key))
+	}
+
+	key := metabase.SegmentKey("abc")
+	_ = key.Next()
+	require.Equal(t, metabase.SegmentKey("abc"), key)
+}
+
+func TestSegmentKeyPrefixSuccessor(t *testing.T) {
+	for _, tt := range []struct {
+		key       metabase.SegmentKey
+		successor metabase.SegmentKey
+	}{
+		{key: nil, successor: nil},
+		{key: metabase.SegmentKey("\xff\xff"), successor: nil},
+		{key: metabase.SegmentKey("a"), successor: metabase.SegmentKey("b")},
+		{key: metabase.SegmentKey("a/"), successor: metabase.SegmentKey("a0")},
+		{key: metabase.SegmentKey("a\xff"), successor: metabase.SegmentKey("b")},
+		{key: metabase.SegmentKey("ab\xff\xff"), successor: metabase.SegmentKey("ac")},
+	} {
+		require.Equal(t, tt.successor, tt.key.PrefixSuccessor(), "%q", tt.key)
+		if tt.successor != nil {
+			require.Equal(t, 1, metabase.CompareSegmentKeys(tt.successor, append(append(metabase.SegmentKey{}, tt.key...), 0xFF, 0xFF)))
+		}
+	}
+
+	key := metabase.SegmentKey("a\xff")
+	_ = key.PrefixSuccessor()
+	require.Equal(t, metabase.SegmentKey("a\xff"), key)
+}
+
+func TestSegmentLocationBucketPrefix(t *testing.T) {
+	for _, seg := range []metabase.SegmentLocation{
+		{},
+		{ProjectID: testrand.UUID(), BucketName: "bucket", ObjectKey: "key"},
+		{ProjectID: testrand.UUID(), BucketName: "bucket", Position: metabase.SegmentPosition{Part: 1, Index: 2}},
+	} {
+		require.Equal(t, seg.Bucket().Prefix(), seg.BucketPrefix())
+	}
+}
+
+func TestSegmentLocationVerifyIndexForCount(t *testing.T) {
+	obj := metabase.ObjectLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "bucket",
+		ObjectKey:  "key",
+	}
+	segment := func(index uint32) metabase.SegmentLocation {
+		return obj.Segment(metabase.SegmentPosition{Index: index})
+	}
+
+	for _, tt := range []struct {
+		segment metabase.SegmentLocation
+		count   int64
+		valid   bool
+	}{
+		{segment: obj.LastSegment(), count: 1, valid: true},
+		{segment: obj.LastSegment(), count: 100, valid: true},
+		{segment: segment(0), count: 1, valid: false},
+		{segment: segment(0), count: 2, valid: true},
+		{segment: segment(3), count: 5, valid: true},
+		{segment: segment(4), count: 5, valid: false},
+		{segment: segment(1000), count: 5, valid: false},
+		{segment: segment(0), count: 0, valid: false},
+		{segment: obj.LastSegment(), count: -1, valid: false},
+	} {
+		err := tt.segment.VerifyIndexForCount(tt.count)
+		if tt.valid {
+			require.NoError(t, err, "%v %d", tt.segment.Position, tt.count)
+		} else {
+			require.True(t, metabase.ErrInvalidRequest.Has(err), "%v %d", tt.segment.Position, tt.count)
+		}
+	}
+
+	segments, err := obj.ReverseSegments(4)
+	require.NoError(t, err)
+	for _, segment := range segments {
+		require.NoError(t, segment.VerifyIndexForCount(4))
+	}
+}
+
+func TestSegmentLocationSameObject(t *testing.T) {
+	seg := metabase.SegmentLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "bucket",
+		ObjectKey:  "key",
+		Position:   metabase.SegmentPosition{Index: 1},
+	}
+
+	other := seg
+	other.Position = metabase.SegmentPosition{Part: 2, Index: metabase.LastSegmentIndex}
+	require.True(t, seg.SameObject(other))
+	require.True(t, seg.SameObject(seg))
+
+	other = seg
+	other.ProjectID = testrand.UUID()
+	require.False(t, seg.SameObject(other))
+
+	other = seg
+	other.BucketName = "other"
+	require.False(t, seg.SameObject(other))
+
+	other = seg
+	other.ObjectKey = "key/"
+	require.False(t, seg.SameObject(other))
+}
+
+func TestSegmentKeyValidateLength(t *testing.T) {
+	require.Equal(t, 4123, metabase.MaxSegmentKeyLength)
+
+	require.NoError(t, metabase.SegmentKey(nil).ValidateLength())
+	require.NoError(t, make(metabase.SegmentKey, metabase.MaxSegmentKeyLength).ValidateLength())
+
+	err := make(metabase.SegmentKey, metabase.MaxSegmentKeyLength+1).ValidateLength()
+	require.Error(t, err)
+	require.True(t, metabase.ErrInvalidRequest.Has(err))
+
+	longest := metabase.SegmentLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: metabase.BucketName(strings.Repeat("b", 63)),
+		ObjectKey:  metabase.ObjectKey(strings.Repeat("k", 4000)),
+		Position:   metabase.SegmentPosition{Part: math.MaxUint32, Index: math.MaxUint32 - 1},
+	}.Encode()
+	require.Len(t, longest, metabase.MaxSegmentKeyLength)
+	require.NoError(t, longest.ValidateLength())
+}
+
+func TestSegmentKeyIsLastSegment(t *testing.T) {
+	var testCases = []struct {
+		key     string
+		last    bool
+		invalid bool
+	}{
+		{key: "bb6218e3-4b4a-4819-abbb-fa68538e33c0/l/testbucket/object", last: true},
+		{key: "bb6218e3-4b4a-4819-abbb-fa68538e33c0/s0/testbucket/object", last: false},
+		{key: "bb6218e3-4b4a-4819-abbb-fa68538e33c0/s4294967296/testbucket/object", last: false},
+		// project ID is not validated.
+		{key: "not UUID string/l/testbucket/object", last: true},
+		{key: "bb6218e3-4b4a-4819-abbb-fa68538e33c0", invalid: true},
+		{key: "bb6218e3-4b4a-4819-abbb-fa68538e33c0/l", invalid: true},
+		{key: "bb6218e3-4b4a-4819-abbb-fa68538e33c0/l0/testbucket/object", invalid: true},
+		{key: "bb6218e3-4b4a-4819-abbb-fa68538e33c0/s/testbucket/object", invalid: true},
+		{key: "bb6218e3-4b4a-4819-abbb-fa68538e33c0/sx/testbucket/object", invalid: true},
+		{key: "bb6218e3-4b4a-4819-abbb-fa68538e33c0/1/testbucket/object", invalid: true},
+	}
+	for _, tt := range testCases {
+		last, err := metabase.SegmentKey(tt.key).IsLastSegment()
+		if tt.invalid {
+			require.Error(t, err, tt.key)
+			continue
+		}
+		require.NoError(t, err, tt.key)
+		require.Equal(t, tt.last, last, tt.key)
+	}
+}
+
+func TestCompareSegmentKeys(t *testing.T) {
+	projectID := uuid.UUID{1}
+	prefix := projectID.String()
+
+	// keys are listed in the order the database sorts them.
+	ordered := []metabase.SegmentKey{
+		metabase.SegmentKey(prefix),
+		metabase.SegmentKey(prefix + "/l/bucket/a"),
+		metabase.SegmentKey(prefix + "/l/bucket/a/b"),
+		metabase.SegmentKey(prefix + "/l/bucket/\x7f"),
+		metabase.SegmentKey(prefix + "/l/bucket/\u00e9"),
+		metabase.SegmentKey(prefix + "/l/bucket/\u65e5\u672c"),
+		metabase.SegmentKey(prefix + "/l/bucket/\xff"),
+		metabase.SegmentKey(prefix + "/s0/bucket/a"),
+		metabase.SegmentKey(prefix + "/s10/bucket/a"),
+		metabase.SegmentKey(prefix + "/s9/bucket/a"),
+	}
+
+	for i := range ordered {
+		require.Zero(t, metabase.CompareSegmentKeys(ordered[i], ordered[i]))
+		for j := i + 1; j < len(ordered); j++ {
+			require.Negative(t, metabase.CompareSegmentKeys(ordered[i], ordered[j]), "%q < %q", ordered[i], ordered[j])
+			require.Positive(t, metabase.CompareSegmentKeys(ordered[j], ordered[i]), "%q > %q", ordered[j], ordered[i])
+		}
+	}
+}
+
+func TestObjectKeyComponents(t *testing.T) {
+	var testCases = []struct {
+		key      metabase.ObjectKey
+		expected []metabase.ObjectKey
+	}{
+		{"", []metabase.ObjectKey{""}},
+		{"object", []metabase.ObjectKey{"object"}},
+		{"a/b/c", []metabase.ObjectKey{"a", "b", "c"}},
+		{"/a/b", []metabase.ObjectKey{"", "a", "b"}},
+		{"a/b/", []metabase.ObjectKey{"a", "b", ""}},
+		{"a//b", []metabase.ObjectKey{"a", "", "b"}},
+		{"/", []metabase.ObjectKey{"", ""}},
+		{"\xff/\x00\x2f", []metabase.ObjectKey{"\xff", "\x00", ""}},
+	}
+	for _, tt := range testCases {
+		require.Equal(t, tt.expected, tt.key.Components(), "%q", tt.key)
+	}
+}
+
+func TestBucketLocationLastSegmentKey(t *testing.T) {
+	bucket := metabase.BucketLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "testbucket",
+	}
+
+	for _, key := range []metabase.ObjectKey{"", "object", "a/b/c", "a/b/", "\xff\x00"} {
+		expected := metabase.SegmentLocation{
+			ProjectID:  bucket.ProjectID,
+			BucketName: bucket.BucketName,
+			ObjectKey:  key,
+			Position:   metabase.SegmentPosition{Index: metabase.LastSegmentIndex},
+		}.Encode()
+		require.Equal(t, expected, bucket.LastSegmentKey(key), "%q", key)
+	}
+}
+
+func TestBucketLocationFirstSegmentKey(t *testing.T) {
+	bucket := metabase.BucketLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "testbucket",
+	}
+	key := metabase.ObjectKey("a/b/c")
+
+	firstKey := bucket.FirstSegmentKey(key)
+	require.Equal(t, metabase.SegmentKey(bucket.ProjectID.String()+"/s0/testbucket/a/b/c"), firstKey)
+	require.Equal(t, metabase.SegmentLocation{
+		ProjectID:  bucket.ProjectID,
+		BucketName: bucket.BucketName,
+		ObjectKey:  key,
+		Position:   metabase.SegmentPosition{Index: metabase.FirstSegmentIndex},
+	}.Encode(), firstKey)
+	require.NotEqual(t, bucket.LastSegmentKey(key), firstKey)
+
+	location, err := metabase.ParseSegmentKey(firstKey)
+	require.NoError(t, err)
+	require.Equal(t, metabase.SegmentPosition{Part: 0, Index: metabase.FirstSegmentIndex}, location.Position)
+	require.Equal(t, key, location.ObjectKey)
+}
+
+func TestBucketLocationContains(t *testing.T) {
+	bucket := metabase.BucketLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "testbucket",
+	}
+
+	segment := metabase.SegmentLocation{
+		ProjectID:  bucket.ProjectID,
+		BucketName: bucket.BucketName,
+		ObjectKey:  "object",
+		Position:   metabase.SegmentPosition{Index: 3},
+	}
+	require.True(t, bucket.Contains(segment))
+
+	otherProject := segment
+	otherProject.ProjectID = testrand.UUID()
+	require.False(t, bucket.Contains(otherProject))
+
+	otherBucket := segment
+	otherBucket.BucketName = "otherbucket"
+	require.False(t, bucket.Contains(otherBucket))
+}
+
+func TestCommonPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		keys   []metabase.ObjectKey
+		prefix metabase.ObjectKey
+	}{
+		{keys: nil, prefix: ""},
+		{keys: []metabase.ObjectKey{"a/b/c"}, prefix: "a/b/c"},
+		{keys: []metabase.ObjectKey{"a/b/c", "a/b/d", "a/bc"}, prefix: "a/b"},
+		{keys: []metabase.ObjectKey{"a/b", "a/b/c"}, prefix: "a/b"},
+		{keys: []metabase.ObjectKey{"abc", "xyz"}, prefix: ""},
+		{keys: []metabase.ObjectKey{"abc", ""}, prefix: ""},
+		{keys: []metabase.ObjectKey{"\xff\x01", "\xff\x02"}, prefix: "\xff"},
+	} {
+		require.Equal(t, tt.prefix, metabase.CommonPrefix(tt.keys), "%q", tt.keys)
+	}
+}
+
+func TestObjectLocationSegmentKeyForPosition(t *testing.T) {
+	obj := metabase.ObjectLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "bucket",
+		ObjectKey:  "a/b/c",
+	}
+
+	for _, pos := range []metabase.SegmentPosition{
+		{},
+		{Index: 5},
+		{Part: 2, Index: 3},
+		{Part: math.MaxUint32, Index: math.MaxUint32 - 1},
+	} {
+		key := obj.SegmentKeyForPosition(pos)
+		require.Equal(t, obj.Segment(pos).Encode(), key)
+
+		parsed, err := metabase.ParseSegmentKey(key)
+		require.NoError(t, err)
+		require.Equal(t, obj.Segment(pos), parsed)
+	}
+
+	key := obj.SegmentKeyForPosition(metabase.SegmentPosition{Index: metabase.LastSegmentIndex})
+	require.Equal(t, metabase.SegmentKey(obj.ProjectID.String()+"/l/bucket/a/b/c"), key)
+
+	parsed, err := metabase.ParseSegmentKey(key)
+	require.NoError(t, err)
+	require.Equal(t, obj.LastSegment(), parsed)
+}
+
+func TestObjectLocationReverseSegments(t *testing.T) {
+	obj := metabase.ObjectLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "bucket",
+		ObjectKey:  "key",
+	}
+
+	segments, err := obj.ReverseSegments(4)
+	require.NoError(t, err)
+	require.Equal(t, []metabase.SegmentLocation{
+		obj.LastSegment(),
+		obj.Segment(metabase.SegmentPosition{Index: 2}),
+		obj.Segment(metabase.SegmentPosition{Index: 1}),
+		obj.Segment(metabase.SegmentPosition{Index: 0}),
+	}, segments)
+
+	segments, err = obj.ReverseSegments(1)
+	require.NoError(t, err)
+	require.Equal(t, []metabase.SegmentLocation{obj.LastSegment()}, segments)
+
+	_, err = obj.ReverseSegments(0)
+	require.True(t, metabase.ErrInvalidRequest.Has(err))
+	_, err = obj.ReverseSegments(-1)
+	require.True(t, metabase.ErrInvalidRequest.Has(err))
+	_, err = obj.ReverseSegments(metabase.MaxReverseSegments + 1)
+	require.True(t, metabase.ErrInvalidRequest.Has(err))
+	_, err = obj.ReverseSegments(int64(metabase.LastSegmentIndex))
+	require.True(t, metabase.ErrInvalidRequest.Has(err))
+}
+
+func TestObjectLocationAllSegmentKeys(t *testing.T) {
+	obj := metabase.ObjectLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "bucket",
+		ObjectKey:  "a/b/c",
+	}
+
+	for _, count := range []int64{1, 2, 3, 17} {
+		keys, err := obj.AllSegmentKeys(count)
+		require.NoError(t, err)
+		require.Len(t, keys, int(count))
+		require.Equal(t, obj.LastSegment().Encode(), keys[0])
+
+		for i, key := range keys {
+			segment, err := metabase.ParseSegmentKey(key)
+			require.NoError(t, err)
+			require.Equal(t, obj, segment.Object())
+			if i > 0 {
+				require.Equal(t, metabase.SegmentPosition{Index: uint32(count - 1 - int64(i))}, segment.Position)
+			}
+		}
+	}
+
+	_, err := obj.AllSegmentKeys(0)
+	require.True(t, metabase.ErrInvalidRequest.Has(err))
+}
+
+func TestObjectKeyValidateAgainst(t *testing.T) {
+	control := func(b byte) bool { return b < 0x20 || b == 0x7f }
+
+	require.NoError(t, metabase.ObjectKey("").ValidateAgainst(control))
+	require.NoError(t, metabase.ObjectKey("dir/file name.txt").ValidateAgainst(control))
+
+	err := metabase.ObjectKey("dir/fi\nle").ValidateAgainst(control)
+	require.True(t, metabase.ErrInvalidRequest.Has(err))
+	require.Contains(t, err.Error(), "byte 0x0a at offset 6")
+
+	err = metabase.ObjectKey("\x7f\x01").ValidateAgainst(control)
+	require.Contains(t, err.Error(), "byte 0x7f at offset 0")
+}
+
+func TestObjectKeyIsUnder(t *testing.T) {
+	for _, tt := range []struct {
+		key, prefix metabase.ObjectKey
+		under       bool
+	}{
+		{key: "a/b/", prefix: "a/b/", under: false},
+		{key: "", prefix: "", under: false},
+		{key: "a/b/c", prefix: "a/b/", under: true},
+		{key: "a/b/", prefix: "a/b", under: true},
+		{key: "a", prefix: "", under: true},
+		{key: "a/c/d", prefix: "a/b/", under: false},
+		{key: "a/b", prefix: "a/b/", under: false},
+		{key: "x", prefix: "a/b/", under: false},
+	} {
+		require.Equal(t, tt.under, tt.key.IsUnder(tt.prefix), "%q under %q", tt.key, tt.prefix)
+	}
+}
+
+func TestObjectKeyDelimiters(t *testing.T) {
+	var testCases = []struct {
+		key      metabase.ObjectKey
+		leading  bool
+		trailing bool
+	}{
+		{"", false, false},
+		{"object", false, false},
+		{"a/b", false, false},
+		{"/a/b", true, false},
+		{"a/b/", false, true},
+		{"/", true, true},
+	}
+	for _, tt := range testCases {
+		require.Equal(t, tt.leading, tt.key.HasLeadingDelimiter(), "%q", tt.key)
+		require.Equal(t, tt.trailing, tt.key.HasTrailingDelimiter(), "%q", tt.key)
+
+		if tt.key == "" {
+			continue
+		}
+
+		location := metabase.ObjectLocation{
+			ProjectID:  testrand.UUID(),
+			BucketName: "testbucket",
+			ObjectKey:  tt.key,
+		}
+		require.NoError(t, location.Verify(), "%q", tt.key)
+		if tt.leading {
+			require.Error(t, location.VerifyStrict(), "%q", tt.key)
+		} else {
+			require.NoError(t, location.VerifyStrict(), "%q", tt.key)
+		}
+	}
+}
+
+func TestPiecesHasDistinctNodes(t *testing.T) {
+	node0 := testrand.NodeID()
+	node1 := testrand.NodeID()
+
+	distinct := metabase.Pieces{
+		{Number: 0, StorageNode: node0},
+		{Number: 1, StorageNode: node1},
+	}
+	require.True(t, distinct.HasDistinctNodes())
+	require.NoError(t, distinct.Verify())
+	require.NoError(t, distinct.VerifyStrict())
+
+	duplicate := metabase.Pieces{
+		{Number: 0, StorageNode: node0},
+		{Number: 1, StorageNode: node1},
+		{Number: 2, StorageNode: node0},
+	}
+	require.False(t, duplicate.HasDistinctNodes())
+	require.NoError(t, duplicate.Verify())
+	require.Error(t, duplicate.VerifyStrict())
+
+	require.True(t, metabase.Pieces{}.HasDistinctNodes())
+	require.Error(t, metabase.Pieces{}.VerifyStrict())
+}
+
+func TestPiecesIsSorted(t *testing.T) {
+	require.True(t, metabase.Pieces(nil).IsSorted())
+	require.True(t, metabase.Pieces{}.IsSorted())
+	require.True(t, metabase.Pieces{{Number: 5}}.IsSorted())
+	require.True(t, metabase.Pieces{{Number: 0}, {Number: 2}, {Number: 7}}.IsSorted())
+
+	require.False(t, metabase.Pieces{{Number: 2}, {Number: 0}}.IsSorted())
+	require.False(t, metabase.Pieces{{Number: 0}, {Number: 7}, {Number: 2}}.IsSorted())
+
+	pieces := metabase.Pieces{{Number: 3}, {Number: 1}, {Number: 2}}
+	sort.Sort(pieces)
+	require.True(t, pieces.IsSorted())
+}
+
+func TestPieceIsWithin(t *testing.T) {
+	require.True(t, metabase.Piece{Number: 0}.IsWithin(1))
+	require.True(t, metabase.Piece{Number: 79}.IsWithin(80))
+	require.True(t, metabase.Piece{Number: math.MaxUint16 - 1}.IsWithin(math.MaxUint16))
+
+	require.False(t, metabase.Piece{Number: 0}.IsWithin(0))
+	require.False(t, metabase.Piece{Number: 80}.IsWithin(80))
+	require.False(t, metabase.Piece{Number: math.MaxUint16}.IsWithin(math.MaxUint16))
+}
+
+func TestPiecesVerifyAgainstScheme(t *testing.T) {
+	pieces := metabase.Pieces{
+		{Number: 0, StorageNode: testrand.NodeID()},
+		{Number: 3, StorageNode: testrand.NodeID()},
+		{Number: 5, StorageNode: testrand.NodeID()},
+	}
+
+	require.NoError(t, pieces.VerifyAgainstScheme(6, 3))
+	require.NoError(t, pieces.VerifyAgainstScheme(10, 2))
+
+	err := pieces.VerifyAgainstScheme(5, 2)
+	require.True(t, metabase.ErrInvalidRequest.Has(err))
+	require.Contains(t, err.Error(), "piece number 5 is out of range")
+
+	err = pieces.VerifyAgainstScheme(6, 4)
+	require.True(t, metabase.ErrInvalidRequest.Has(err))
+	require.Contains(t, err.Error(), "less than required")
+
+	require.Error(t, metabase.Pieces{}.VerifyAgainstScheme(6, 1))
+
+	duplicated := metabase.Pieces{
+		{Number: 0, StorageNode: testrand.NodeID()},
+		{Number: 0, StorageNode: testrand.NodeID()},
+		{Number: 0, StorageNode: testrand.NodeID()},
+	}
+	err = duplicated.VerifyAgainstScheme(6, 3)
+	require.True(t, metabase.ErrInvalidRequest.Has(err))
+	require.Contains(t, err.Error(), "distinct pieces 1 is less than required 3")
+	require.NoError(t, duplicated.VerifyAgainstScheme(6, 1))
+}
+
+func TestVerifySegmentsAgainstScheme(t *testing.T) {
+	pieces := func(numbers ...uint16) metabase.Pieces {
+		var pieces metabase.Pieces
+		for _, number := range numbers {
+			pieces = append(pieces, metabase.Piece{Number: number, StorageNode: testrand.NodeID()})
+		}
+		return pieces
+	}
+
+	inconsistent, err := metabase.VerifySegmentsAgainstScheme(nil, 6, 3)
+	require.NoError(t, err)
+	require.Empty(t, inconsistent)
+
+	inconsistent, err = metabase.VerifySegmentsAgainstScheme([]metabase.Pieces{
+		pieces(0, 1, 2),
+		pieces(3, 4, 5),
+		pieces(0, 2, 4, 5),
+	}, 6, 3)
+	require.NoError(t, err)
+	require.Empty(t, inconsistent)
+
+	inconsistent, err = metabase.VerifySegmentsAgainstScheme([]metabase.Pieces{
+		pieces(0, 1, 2),
+		pieces(0, 1),
+		pieces(3, 4, 5),
+		pieces(0, 1, 6),
+		pieces(2, 2, 2),
+	}, 6, 3)
+	require.True(t, metabase.ErrInvalidRequest.Has(err))
+	require.Equal(t, []int{1, 3, 4}, inconsistent)
+	require.Contains(t, err.Error(), "segment 1: ")
+	require.Contains(t, err.Error(), "segment 3: ")
+	require.NotContains(t, err.Error(), "segment 0: ")
+}
+
+func TestPartitionKeyspace(t *testing.T) {
+	bucket := metabase.BucketLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "testbucket",
+	}
+	prefix := metabase.SegmentKey(bucket.ProjectID.String() + "/l/testbucket/")
+	end := metabase.SegmentKey(bucket.ProjectID.String() + "/l/testbucket0")
+
+	ranges := metabase.PartitionKeyspace(bucket, 1)
+	require.Equal(t, []metabase.SegmentKeyRange{{Start: prefix, End: end}}, ranges)
+
+	withByte := func(b byte) metabase.SegmentKey {
+		return append(append(metabase.SegmentKey{}, prefix...), b)
+	}
+
+	ranges = metabase.PartitionKeyspace(bucket, 4)
+	require.Equal(t, []metabase.SegmentKeyRange{
+		{Start: prefix, End: withByte(0x40)},
+		{Start: withByte(0x40), End: withByte(0x80)},
+		{Start: withByte(0x80), End: withByte(0xC0)},
+		{Start: withByte(0xC0), End: end},
+	}, ranges)
+	require.Equal(t, ranges, metabase.PartitionKeyspace(bucket, 4))
+
+	for _, shards := range []int{0, 1, 3, 4, 7, 256, 1000} {
+		ranges := metabase.PartitionKeyspace(bucket, shards)
+		require.NotEmpty(t, ranges)
+		require.LessOrEqual(t, len(ranges), 256)
+
+		require.Equal(t, prefix, ranges[0].Start)
+		require.Equal(t, end, ranges[len(ranges)-1].End)
+		for i, r := range ranges {
+			require.Negative(t, metabase.CompareSegmentKeys(r.Start, r.End), "shards %d range %d", shards, i)
+			if i > 0 {
+				require.Equal(t, ranges[i-1].End, r.Start, "shards %d range %d", shards, i)
+			}
+		}
+
+		// every object in the bucket falls in exactly one range.
+		for _, key := range []metabase.ObjectKey{"", "a", "\x00", "\x7f/b", "\xff\xff"} {
+			encoded := bucket.LastSegmentKey(key)
+
+			matches := 0
+			for _, r := range ranges {
+				if metabase.CompareSegmentKeys(r.Start, encoded) <= 0 && metabase.CompareSegmentKeys(encoded, r.End) < 0 {
+					matches++
+				}
+			}
+			require.Equal(t, 1, matches, "shards %d key %q", shards, key)
+		}
+	}
+}
+
 func TestPiecesEqual(t *testing.T) {
 	sn1 := testrand.NodeID()
 	sn2 := testrand.NodeID()
@@ -721,6 +1584,283 @@ func TestPiecesUpdate(t *testing.T) {
 	}
 }
 
+func TestPiecesMerge(t *testing.T) {
+	node0 := testrand.NodeID()
+	node1 := testrand.NodeID()
+	node2 := testrand.NodeID()
+	node3 := testrand.NodeID()
+
+	tests := []struct {
+		name   string
+		pieces metabase.Pieces
+		other  metabase.Pieces
+		want   metabase.Pieces
+	}{
+		{
+			name:   "disjoint",
+			pieces: metabase.Pieces{{Number: 2, StorageNode: node2}, {Number: 0, StorageNode: node0}},
+			other:  metabase.Pieces{{Number: 1, StorageNode: node1}},
+			want: metabase.Pieces{
+				{Number: 0, StorageNode: node0},
+				{Number: 1, StorageNode: node1},
+				{Number: 2, StorageNode: node2},
+			},
+		},
+		{
+			name:   "overlapping numbers",
+			pieces: metabase.Pieces{{Number: 0, StorageNode: node0}, {Number: 1, StorageNode: node1}},
+			other:  metabase.Pieces{{Number: 1, StorageNode: node3}, {Number: 2, StorageNode: node2}},
+			want: metabase.Pieces{
+				{Number: 0, StorageNode: node0},
+				{Number: 1, StorageNode: node3},
+				{Number: 2, StorageNode: node2},
+			},
+		},
+		{
+			name:   "identical",
+			pieces: metabase.Pieces{{Number: 0, StorageNode: node0}, {Number: 1, StorageNode: node1}},
+			other:  metabase.Pieces{{Number: 0, StorageNode: node0}, {Number: 1, StorageNode: node1}},
+			want:   metabase.Pieces{{Number: 0, StorageNode: node0}, {Number: 1, StorageNode: node1}},
+		},
+		{
+			name:   "both empty",
+			pieces: metabase.Pieces{},
+			other:  metabase.Pieces{},
+			want:   metabase.Pieces{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.pieces.Merge(tt.other))
+		})
+	}
+}
+
+func TestPiecesIntersectNumbers(t *testing.T) {
+	node0 := testrand.NodeID()
+	node1 := testrand.NodeID()
+	node2 := testrand.NodeID()
+
+	pieces := metabase.Pieces{
+		{Number: 4, StorageNode: node2},
+		{Number: 0, StorageNode: node0},
+		{Number: 2, StorageNode: node1},
+	}
+
+	var testCases = []struct {
+		name     string
+		other    metabase.Pieces
+		expected []uint16
+	}{
+		{
+			name:     "full overlap",
+			other:    metabase.Pieces{{Number: 2, StorageNode: node0}, {Number: 0, StorageNode: node1}, {Number: 4, StorageNode: node2}},
+			expected: []uint16{0, 2, 4},
+		},
+		{
+			name:     "partial overlap",
+			other:    metabase.Pieces{{Number: 4, StorageNode: node0}, {Number: 1, StorageNode: node1}, {Number: 0, StorageNode: node0}},
+			expected: []uint16{0, 4},
+		},
+		{
+			name:     "disjoint",
+			other:    metabase.Pieces{{Number: 1, StorageNode: node0}, {Number: 3, StorageNode: node1}},
+			expected: nil,
+		},
+		{
+			name:     "empty",
+			other:    metabase.Pieces{},
+			expected: nil,
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, pieces.IntersectNumbers(tt.other))
+			require.Equal(t, tt.expected, tt.other.IntersectNumbers(pieces))
+		})
+	}
+}
+
+func TestPiecesMissingNumbers(t *testing.T) {
+	full := metabase.Pieces{
+		{Number: 2, StorageNode: testrand.NodeID()},
+		{Number: 0, StorageNode: testrand.NodeID()},
+		{Number: 1, StorageNode: testrand.NodeID()},
+		{Number: 3, StorageNode: testrand.NodeID()},
+	}
+	require.Empty(t, full.MissingNumbers(4))
+
+	require.Equal(t, []uint16{0, 1, 2, 3}, metabase.Pieces{}.MissingNumbers(4))
+	require.Empty(t, metabase.Pieces{}.MissingNumbers(0))
+
+	partial := metabase.Pieces{
+		{Number: 5, StorageNode: testrand.NodeID()},
+		{Number: 1, StorageNode: testrand.NodeID()},
+		{Number: 9, StorageNode: testrand.NodeID()},
+	}
+	require.Equal(t, []uint16{0, 2, 3, 4, 6}, partial.MissingNumbers(7))
+}
+
+func TestPiecesString(t *testing.T) {
+	node0 := testrand.NodeID()
+	node1 := testrand.NodeID()
+
+	pieces := metabase.Pieces{
+		{Number: 7, StorageNode: node1},
+		{Number: 2, StorageNode: node0},
+	}
+	require.Equal(t, "[2:"+node0.String()[:8]+", 7:"+node1.String()[:8]+"]", pieces.String())
+	require.Equal(t, metabase.Piece{Number: 7, StorageNode: node1}, pieces[0], "String must not reorder pieces")
+
+	require.Equal(t, "[]", metabase.Pieces{}.String())
+}
+
+func TestPiecesAuditDiff(t *testing.T) {
+	nodeA := testrand.NodeID()
+	nodeB := testrand.NodeID()
+	nodeC := testrand.NodeID()
+
+	before := metabase.Pieces{
+		{Number: 3, StorageNode: nodeA},
+		{Number: 1, StorageNode: nodeB},
+		{Number: 4, StorageNode: nodeC},
+	}
+	after := metabase.Pieces{
+		{Number: 5, StorageNode: nodeC},
+		{Number: 3, StorageNode: nodeB},
+		{Number: 4, StorageNode: nodeC},
+		{Number: 2, StorageNode: nodeA},
+	}
+
+	short := func(id storj.NodeID) string { return id.String()[:8] }
+	require.Equal(t,
+		"added 2,5; removed 1; moved 3 node "+short(nodeA)+"->"+short(nodeB),
+		before.AuditDiff(after))
+
+	require.Equal(t, "unchanged", before.AuditDiff(before))
+	require.Equal(t, "removed 1,3,4", before.AuditDiff(nil))
+}
+
+func TestValidateBatchSize(t *testing.T) {
+	limit := metabase.ListLimit.Max() + 1
+
+	require.NoError(t, metabase.ValidateBatchSize(0))
+	require.NoError(t, metabase.ValidateBatchSize(limit))
+
+	err := metabase.ValidateBatchSize(limit + 1)
+	require.Error(t, err)
+	require.True(t, metabase.ErrInvalidRequest.Has(err))
+}
+
+func TestSegmentCountForSize(t *testing.T) {
+	const segmentSize = 64 << 20
+
+	for _, tt := range []struct {
+		size  int64
+		count int64
+	}{
+		{size: 0, count: 1},
+		{size: 1, count: 1},
+		{size: segmentSize, count: 1},
+		{size: 3 * segmentSize, count: 3},
+		{size: 3*segmentSize + 1, count: 4},
+		{size: 3*segmentSize - 1, count: 3},
+	} {
+		count, err := metabase.SegmentCountForSize(tt.size, segmentSize)
+		require.NoError(t, err)
+		require.Equal(t, tt.count, count, "size %d", tt.size)
+	}
+
+	for _, segmentSize := range []int64{0, -1} {
+		_, err := metabase.SegmentCountForSize(1, segmentSize)
+		require.True(t, metabase.ErrInvalidRequest.Has(err))
+	}
+}
+
+func TestObjectStreamBucket(t *testing.T) {
+	obj := metabase.ObjectStream{
+		ProjectID:  testrand.UUID(),
+		BucketName: "bucket",
+		ObjectKey:  "key",
+		Version:    1,
+		StreamID:   testrand.UUID(),
+	}
+
+	require.Equal(t, metabase.BucketLocation{
+		ProjectID:  obj.ProjectID,
+		BucketName: "bucket",
+	}, obj.Bucket())
+	require.Equal(t, obj.Location().Bucket(), obj.Bucket())
+}
+
+func TestObjectStreamSameObject(t *testing.T) {
+	obj := metabase.ObjectStream{
+		ProjectID:  testrand.UUID(),
+		BucketName: "bucket",
+		ObjectKey:  "key",
+		Version:    1,
+		StreamID:   testrand.UUID(),
+	}
+	require.True(t, obj.SameObject(obj))
+
+	other := obj
+	other.Version = 2
+	other.StreamID = testrand.UUID()
+	require.True(t, obj.SameObject(other))
+
+	other = obj
+	other.ProjectID = testrand.UUID()
+	require.False(t, obj.SameObject(other))
+
+	other = obj
+	other.BucketName = "other"
+	require.False(t, obj.SameObject(other))
+
+	other = obj
+	other.ObjectKey = "key/"
+	require.False(t, obj.SameObject(other))
+}
+
+func TestObjectStreamWithVersion(t *testing.T) {
+	obj := metabase.ObjectStream{
+		ProjectID:  testrand.UUID(),
+		BucketName: "bucket",
+		ObjectKey:  "key",
+		Version:    1,
+		StreamID:   testrand.UUID(),
+	}
+	original := obj
+
+	bumped := obj.WithVersion(5)
+	require.Equal(t, metabase.Version(5), bumped.Version)
+	require.Equal(t, original, obj)
+
+	bumped.Version = obj.Version
+	require.Equal(t, obj, bumped)
+}
+
+func TestObjectStreamRedacted(t *testing.T) {
+	obj := metabase.ObjectStream{
+		ProjectID:  testrand.UUID(),
+		BucketName: "bucket",
+		ObjectKey:  "secret/encrypted/key",
+		Version:    7,
+		StreamID:   testrand.UUID(),
+	}
+
+	redacted := obj.Redacted()
+	require.True(t, strings.HasPrefix(redacted, obj.ProjectID.String()+"/bucket/"), redacted)
+	require.True(t, strings.HasSuffix(redacted, "@v7"), redacted)
+	require.NotContains(t, redacted, string(obj.ObjectKey))
+	require.NotContains(t, redacted, "secret")
+
+	require.Equal(t, redacted, obj.Redacted())
+
+	other := obj
+	other.ObjectKey = "secret/encrypted/other"
+	require.NotEqual(t, redacted, other.Redacted())
+}
+
 func TestStreamVersionID(t *testing.T) {
 	expectedVersion := metabase.Version(1)
 	expectedStreamID := uuid.UUID{2, 2, 2, 2, 2, 2, 2, 2, 4, 4, 4, 4, 4, 4, 4, 4}
@@ -782,3 +1922,114 @@ func BenchmarkSegmentPieceSize(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkLastSegmentKey(b *testing.B) {
+	bucket := metabase.BucketLocation{
+		ProjectID:  testrand.UUID(),
+		BucketName: "testbucket",
+	}
+	key := metabase.ObjectKey("some/nested/object/key")
+
+	b.Run("SegmentLocation.Encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for k := 0; k < b.N; k++ {
+			_ = metabase.SegmentLocation{
+				ProjectID:  bucket.ProjectID,
+				BucketName: bucket.BucketName,
+				ObjectKey:  key,
+				Position:   metabase.SegmentPosition{Index: metabase.LastSegmentIndex},
+			}.Encode()
+		}
+	})
+
+	b.Run("BucketLocation.LastSegmentKey", func(b *testing.B) {
+		b.ReportAllocs()
+		for k := 0; k < b.N; k++ {
+			_ = bucket.LastSegmentKey(key)
+		}
+	})
+}
+
+func TestEncodeSegmentKeys(t *testing.T) {
+	require.Empty(t, metabase.EncodeSegmentKeys(nil))
+
+	projectID := testrand.UUID()
+	locs := []metabase.SegmentLocation{
+		{ProjectID: projectID, BucketName: "bucket", ObjectKey: "a/b", Position: metabase.SegmentPosition{}},
+		{ProjectID: projectID, BucketName: "bucket", ObjectKey: "a/b", Position: metabase.SegmentPosition{Part: 1, Index: 7}},
+		{ProjectID: projectID, BucketName: "bucket", ObjectKey: "a/b", Position: metabase.SegmentPosition{Index: metabase.LastSegmentIndex}},
+		{ProjectID: testrand.UUID(), BucketName: "other", ObjectKey: "", Position: metabase.SegmentPosition{Part: math.MaxUint32, Index: math.MaxUint32 - 1}},
+		{ProjectID: projectID, BucketName: "bucket", ObjectKey: "\xff/x", Position: metabase.SegmentPosition{Index: 3}},
+		{},
+	}
+
+	keys := metabase.EncodeSegmentKeys(locs)
+	require.Len(t, keys, len(locs))
+	for i, loc := range locs {
+		require.Equal(t, loc.Encode(), keys[i], "%d", i)
+	}
+
+	// appending to a key must not change the following one.
+	_ = append(keys[0], 'x')
+	require.Equal(t, locs[1].Encode(), keys[1])
+}
+
+func BenchmarkEncodeSegmentKeys(b *testing.B) {
+	projectID := testrand.UUID()
+	locs := make([]metabase.SegmentLocation, 1000)
+	for i := range locs {
+		locs[i] = metabase.SegmentLocation{
+			ProjectID:  projectID,
+			BucketName: "testbucket",
+			ObjectKey:  metabase.ObjectKey("some/nested/object/key" + strconv.Itoa(i)),
+			Position:   metabase.SegmentPosition{Index: uint32(i % 10)},
+		}
+	}
+
+	b.Run("SegmentLocation.Encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for k := 0; k < b.N; k++ {
+			keys := make([]metabase.SegmentKey, len(locs))
+			for i, loc := range locs {
+				keys[i] = loc.Encode()
+			}
+		}
+	})
+
+	b.Run("EncodeSegmentKeys", func(b *testing.B) {
+		b.ReportAllocs()
+		for k := 0; k < b.N; k++ {
+			_ = metabase.EncodeSegmentKeys(locs)
+		}
+	})
+}
+
+func TestLocationStrings(t *testing.T) {
+	obj := metabase.ObjectStream{
+		ProjectID:  testrand.UUID(),
+		BucketName: "bucket",
+		ObjectKey:  "\x00\xffkey/\n",
+		Version:    12,
+		StreamID:   testrand.UUID(),
+	}
+	hexKey := hex.EncodeToString([]byte(obj.ObjectKey))
+
+	require.Equal(t, obj.ProjectID.String()+"/bucket/"+hexKey, obj.Location().String())
+	require.Equal(t, obj.ProjectID.String()+"/bucket/"+hexKey+"@v12/"+obj.StreamID.String(), obj.String())
+
+	location := obj.Location()
+	for _, tt := range []struct {
+		segment metabase.SegmentLocation
+		token   string
+	}{
+		{segment: location.LastSegment(), token: "l"},
+		{segment: location.FirstSegment(), token: "s0"},
+		{segment: location.Segment(metabase.SegmentPosition{Part: 1, Index: 2}), token: "s4294967298"},
+	} {
+		str := tt.segment.String()
+		require.Equal(t, obj.ProjectID.String()+"/"+tt.token+"/bucket/"+hexKey, str)
+		require.True(t, strings.HasPrefix(string(tt.segment.Encode()), strings.TrimSuffix(str, hexKey)), str)
+		require.NotContains(t, str, string(obj.ObjectKey))
+		require.Equal(t, str, fmt.Sprint(tt.segment))
+	}
+}
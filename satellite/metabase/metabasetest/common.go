@@ -75,6 +75,13 @@ func sortRawSegments(segments []metabase.RawSegment) {
 	})
 }
 
+// AssertKeyRoundTrips checks that the object key is preserved when encoding
+// segment locations into segment keys and parsing them back.
+func AssertKeyRoundTrips(t testing.TB, key metabase.ObjectKey) {
+	t.Helper()
+	require.NoError(t, metabase.VerifyKeyRoundTrip(key))
+}
+
 func checkError(t require.TestingT, err error, errClass *errs.Class, errText string) {
 	if errClass != nil {
 		require.True(t, errClass.Has(err), "expected an error %q got %q", *errClass, err)